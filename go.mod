@@ -3,6 +3,8 @@ module lops
 go 1.20
 
 require (
+	github.com/denisbrodbeck/machineid v1.0.1
+	github.com/google/uuid v1.6.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/quic-go/quic-go v0.34.0
 )
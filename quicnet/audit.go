@@ -0,0 +1,56 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// AuditEvent 为一条审计记录
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Principal Principal `json:"principal"`
+	// Action 为消息类型或 authenticate
+	Action    string `json:"action"`
+	MessageID string `json:"message_id,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Allowed   bool   `json:"allowed"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type AuditFunc func(event AuditEvent)
+
+// WithAudit 设置审计记录的输出，未设置时只有被拒绝的请求会写入日志
+func WithAudit(fn AuditFunc) ServerOption {
+	return func(s *Server) {
+		s.audit = fn
+	}
+}
+
+// NewJSONAuditLog 返回将审计记录以 JSON Lines 写入 w 的 AuditFunc
+func NewJSONAuditLog(w io.Writer) AuditFunc {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(event AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(event); err != nil {
+			log.Printf("Failed to write audit event: %s", err)
+		}
+	}
+}
+
+func (s *Server) auditLog(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if s.audit != nil {
+		s.audit(event)
+		return
+	}
+	if !event.Allowed {
+		log.Printf("Denied %s for %s: %s", event.Action, event.Principal, event.Reason)
+	}
+}
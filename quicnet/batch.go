@@ -0,0 +1,441 @@
+package quicnet
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultBatchMaxInFlight = 50
+
+type HostStatus string
+
+const (
+	HostPending     HostStatus = "pending"
+	HostSucceeded   HostStatus = "succeeded"
+	HostFailed      HostStatus = "failed"
+	HostUnreachable HostStatus = "unreachable"
+	HostSkipped     HostStatus = "skipped"
+)
+
+type BatchState string
+
+const (
+	BatchRunning   BatchState = "running"
+	BatchPaused    BatchState = "paused"
+	BatchCompleted BatchState = "completed"
+	BatchAborted   BatchState = "aborted"
+	BatchCanceled  BatchState = "canceled"
+)
+
+type HostResult struct {
+	MachineID string
+	Status    HostStatus
+	Result    *ScriptResult
+	Err       error
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+type BatchOptions struct {
+	// MaxInFlight 为同时执行的主机数上限，默认 50
+	MaxInFlight int
+	// HostTimeout 为单台主机等待结果的时间，0 表示按脚本超时再多等一分钟
+	HostTimeout time.Duration
+	// Strategy 为空时所有主机作为一个批次执行
+	Strategy *RolloutStrategy
+}
+
+// RolloutStrategy 先在金丝雀主机上执行，再按批次推进，失败超过阈值时中止剩余主机
+type RolloutStrategy struct {
+	Canary int
+	// BatchSize 与 BatchPercent 二选一，都为 0 时金丝雀之后的主机作为一个批次
+	BatchSize    int
+	BatchPercent int
+	// Pause 为批次之间的暂停时间
+	Pause time.Duration
+	// MaxFailures 与 MaxFailurePercent 为 0 表示不限制，百分比按已开始的批次中的主机数计算，
+	// 金丝雀失败即可中止，而不会因为第一台完成的主机失败就中止后续批次
+	MaxFailures       int
+	MaxFailurePercent int
+}
+
+func (rs *RolloutStrategy) phases(hosts []string) [][]string {
+	var phases [][]string
+	if rs.Canary > 0 {
+		n := rs.Canary
+		if n > len(hosts) {
+			n = len(hosts)
+		}
+		phases = append(phases, hosts[:n])
+		hosts = hosts[n:]
+	}
+
+	size := rs.BatchSize
+	if size <= 0 && rs.BatchPercent > 0 {
+		size = (len(hosts)*rs.BatchPercent + 99) / 100
+	}
+	if size <= 0 {
+		size = len(hosts)
+	}
+	for len(hosts) > 0 {
+		if size > len(hosts) {
+			size = len(hosts)
+		}
+		phases = append(phases, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return phases
+}
+
+// exceeded 判断失败是否超过阈值，planned 为已开始的批次中的主机总数
+func (rs *RolloutStrategy) exceeded(summary *BatchSummary, planned int) bool {
+	failed := len(summary.Failed)
+	if rs.MaxFailures > 0 && failed > rs.MaxFailures {
+		return true
+	}
+	return rs.MaxFailurePercent > 0 && planned > 0 && failed*100 > rs.MaxFailurePercent*planned
+}
+
+type BatchSummary struct {
+	Total       int
+	Succeeded   []string
+	Failed      []string
+	Unreachable []string
+	Skipped     []string
+}
+
+// Done 返回已执行完成（不含跳过）的主机数
+func (bs *BatchSummary) Done() int {
+	return len(bs.Succeeded) + len(bs.Failed) + len(bs.Unreachable)
+}
+
+type BatchProgress struct {
+	State BatchState
+	// Phase 为当前批次序号（从 1 开始），有金丝雀时第 1 批为金丝雀
+	Phase       int
+	Phases      int
+	Summary     BatchSummary
+	AbortReason string
+}
+
+// Batch 表示一次在多台主机上执行同一脚本任务的批量执行
+type Batch struct {
+	ID string
+
+	server  *Server
+	req     *ScriptTaskRequest
+	hosts   []string
+	opts    BatchOptions
+	results chan *HostResult
+	done    chan struct{}
+	cancel  context.CancelFunc
+	abort   chan struct{}
+
+	mu          sync.Mutex
+	summary     BatchSummary
+	state       BatchState
+	phase       int
+	phases      int
+	planned     int
+	resume      chan struct{}
+	abortReason string
+}
+
+// RunBatch 在 machineIDs 上并发执行 req，结果通过 Results 逐个返回
+func (s *Server) RunBatch(ctx context.Context, machineIDs []string, req *ScriptTaskRequest, opts BatchOptions) *Batch {
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = defaultBatchMaxInFlight
+	}
+	if opts.HostTimeout <= 0 {
+		timeout := time.Duration(req.Timeout) * time.Second
+		if timeout <= 0 {
+			timeout = defaultScriptTimeout
+		}
+		opts.HostTimeout = timeout + time.Minute
+	}
+	if req.TaskID == "" {
+		req.TaskID = uuid.New().String()
+	}
+
+	// 订阅者在整个批次结束后才关闭，而不是第一台 agent 结束时
+	if req.StreamOutput {
+		s.output.hold(req.TaskID)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Batch{
+		ID:      req.TaskID,
+		server:  s,
+		req:     req,
+		hosts:   machineIDs,
+		opts:    opts,
+		results: make(chan *HostResult, len(machineIDs)),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+		abort:   make(chan struct{}),
+		summary: BatchSummary{Total: len(machineIDs)},
+		state:   BatchRunning,
+	}
+	go b.run(ctx)
+	return b
+}
+
+// RunBatchSelect 在匹配选择器表达式的已连接 agent 上执行 req
+func (s *Server) RunBatchSelect(ctx context.Context, selector string, req *ScriptTaskRequest, opts BatchOptions) (*Batch, error) {
+	machineIDs, err := s.cm.SelectMachineIDs(selector)
+	if err != nil {
+		return nil, err
+	}
+	return s.RunBatch(ctx, machineIDs, req, opts), nil
+}
+
+func (b *Batch) run(ctx context.Context) {
+	defer close(b.done)
+	defer close(b.results)
+	defer b.cancel()
+	if b.req.StreamOutput {
+		defer b.server.output.release(b.req.TaskID)
+	}
+
+	phases := [][]string{b.hosts}
+	if b.opts.Strategy != nil {
+		phases = b.opts.Strategy.phases(b.hosts)
+	}
+	b.mu.Lock()
+	b.phases = len(phases)
+	b.mu.Unlock()
+
+	for i, hosts := range phases {
+		if i > 0 && b.opts.Strategy.Pause > 0 {
+			select {
+			case <-time.After(b.opts.Strategy.Pause):
+			case <-ctx.Done():
+			case <-b.abort:
+			}
+		}
+		b.mu.Lock()
+		b.phase = i + 1
+		b.planned += len(hosts)
+		b.mu.Unlock()
+		b.runHosts(ctx, hosts)
+	}
+
+	b.mu.Lock()
+	switch {
+	case b.state == BatchAborted:
+	case ctx.Err() != nil:
+		b.state = BatchCanceled
+	default:
+		b.state = BatchCompleted
+	}
+	b.mu.Unlock()
+}
+
+func (b *Batch) runHosts(ctx context.Context, hosts []string) {
+	sem := make(chan struct{}, b.opts.MaxInFlight)
+	var wg sync.WaitGroup
+	for _, machineID := range hosts {
+		b.waitResume(ctx)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		case <-b.abort:
+		}
+		if b.stopped(ctx) {
+			b.record(&HostResult{MachineID: machineID, Status: HostSkipped})
+			continue
+		}
+
+		wg.Add(1)
+		go func(machineID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b.record(b.runHost(ctx, machineID))
+		}(machineID)
+	}
+	wg.Wait()
+}
+
+func (b *Batch) runHost(ctx context.Context, machineID string) *HostResult {
+	hr := &HostResult{MachineID: machineID, StartTime: time.Now()}
+	defer func() { hr.EndTime = time.Now() }()
+
+	ctx, cancel := context.WithTimeout(ctx, b.opts.HostTimeout)
+	defer cancel()
+
+	req := *b.req
+	f, err := b.server.Dispatch(ctx, machineID, &req)
+	if err == nil {
+		hr.Result, err = f.Result()
+	}
+	switch {
+	case errors.Is(err, ErrClientNotFound), errors.Is(err, ErrClientDisconnected), errors.Is(err, ErrClientClosed):
+		hr.Status = HostUnreachable
+		hr.Err = err
+	case errors.Is(err, ErrAgentNotAccepted), errors.As(err, new(*PermissionError)):
+		hr.Status = HostSkipped
+		hr.Err = err
+	case errors.Is(err, context.DeadlineExceeded) && b.offline(machineID):
+		// 执行期间断线且超时前未重连
+		hr.Status = HostUnreachable
+		hr.Err = err
+	case err != nil:
+		hr.Status = HostFailed
+		hr.Err = err
+	case hr.Result.Code != CodeSuccess || hr.Result.ExitCode != 0:
+		hr.Status = HostFailed
+	default:
+		hr.Status = HostSucceeded
+	}
+	return hr
+}
+
+func (b *Batch) offline(machineID string) bool {
+	p, ok := b.server.cm.Presence(machineID)
+	return !ok || p.State == PresenceOffline
+}
+
+func (b *Batch) record(hr *HostResult) {
+	b.mu.Lock()
+	switch hr.Status {
+	case HostSucceeded:
+		b.summary.Succeeded = append(b.summary.Succeeded, hr.MachineID)
+	case HostUnreachable:
+		b.summary.Unreachable = append(b.summary.Unreachable, hr.MachineID)
+	case HostSkipped:
+		b.summary.Skipped = append(b.summary.Skipped, hr.MachineID)
+	default:
+		b.summary.Failed = append(b.summary.Failed, hr.MachineID)
+	}
+	if hr.Status == HostFailed && b.opts.Strategy != nil && b.opts.Strategy.exceeded(&b.summary, b.planned) {
+		b.abortLocked("failure threshold exceeded")
+	}
+	b.mu.Unlock()
+	b.results <- hr
+}
+
+func (b *Batch) stopped(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	select {
+	case <-b.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitResume 在批量执行暂停时阻塞，直到恢复、中止或取消
+func (b *Batch) waitResume(ctx context.Context) {
+	b.mu.Lock()
+	resume := b.resume
+	b.mu.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-ctx.Done():
+	case <-b.abort:
+	}
+}
+
+func (b *Batch) abortLocked(reason string) {
+	if b.state == BatchAborted {
+		return
+	}
+	b.state = BatchAborted
+	b.abortReason = reason
+	close(b.abort)
+	if b.resume != nil {
+		close(b.resume)
+		b.resume = nil
+	}
+}
+
+// Pause 暂停派发新的主机，已在执行的主机不受影响
+func (b *Batch) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BatchRunning {
+		b.state = BatchPaused
+		b.resume = make(chan struct{})
+	}
+}
+
+func (b *Batch) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BatchPaused {
+		b.state = BatchRunning
+		close(b.resume)
+		b.resume = nil
+	}
+}
+
+// Abort 跳过尚未开始的主机，已在执行的主机会执行完毕。已结束的批量执行不受影响
+func (b *Batch) Abort(reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finishedLocked() {
+		return
+	}
+	b.abortLocked(reason)
+}
+
+func (b *Batch) finishedLocked() bool {
+	return b.state == BatchCompleted || b.state == BatchCanceled || b.state == BatchAborted
+}
+
+func (b *Batch) Progress() BatchProgress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BatchProgress{
+		State:       b.state,
+		Phase:       b.phase,
+		Phases:      b.phases,
+		Summary:     b.summaryLocked(),
+		AbortReason: b.abortReason,
+	}
+}
+
+// Results 返回逐个完成的主机结果，批量执行结束后关闭
+func (b *Batch) Results() <-chan *HostResult {
+	return b.results
+}
+
+func (b *Batch) Done() <-chan struct{} {
+	return b.done
+}
+
+// Summary 返回当前进度的快照
+func (b *Batch) Summary() BatchSummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.summaryLocked()
+}
+
+func (b *Batch) summaryLocked() BatchSummary {
+	return BatchSummary{
+		Total:       b.summary.Total,
+		Succeeded:   append([]string(nil), b.summary.Succeeded...),
+		Failed:      append([]string(nil), b.summary.Failed...),
+		Unreachable: append([]string(nil), b.summary.Unreachable...),
+		Skipped:     append([]string(nil), b.summary.Skipped...),
+	}
+}
+
+// Wait 等待批量执行结束并返回汇总
+func (b *Batch) Wait() BatchSummary {
+	<-b.done
+	return b.Summary()
+}
+
+// Cancel 取消批量执行，包括正在执行的主机
+func (b *Batch) Cancel() {
+	b.cancel()
+}
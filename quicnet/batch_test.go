@@ -0,0 +1,220 @@
+package quicnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRolloutStrategyPhases(t *testing.T) {
+	hosts := []string{"h1", "h2", "h3", "h4", "h5", "h6"}
+
+	tests := []struct {
+		name     string
+		strategy RolloutStrategy
+		expected [][]string
+	}{
+		{"no batches", RolloutStrategy{}, [][]string{hosts}},
+		{"canary only", RolloutStrategy{Canary: 1}, [][]string{{"h1"}, {"h2", "h3", "h4", "h5", "h6"}}},
+		{"batch size", RolloutStrategy{Canary: 1, BatchSize: 2}, [][]string{{"h1"}, {"h2", "h3"}, {"h4", "h5"}, {"h6"}}},
+		{"batch percent", RolloutStrategy{BatchPercent: 50}, [][]string{{"h1", "h2", "h3"}, {"h4", "h5", "h6"}}},
+	}
+
+	for _, tt := range tests {
+		phases := tt.strategy.phases(hosts)
+		if !reflect.DeepEqual(phases, tt.expected) {
+			t.Errorf("%s: expected phases %v, but got %v", tt.name, tt.expected, phases)
+		}
+	}
+}
+
+func TestRolloutStrategyExceeded(t *testing.T) {
+	summary := &BatchSummary{
+		Succeeded: []string{"h1", "h2", "h3"},
+		Failed:    []string{"h4"},
+	}
+
+	if (&RolloutStrategy{MaxFailures: 1}).exceeded(summary, 4) {
+		t.Errorf("Expected 1 failure not to exceed MaxFailures=1")
+	}
+	if !(&RolloutStrategy{MaxFailurePercent: 20}).exceeded(summary, 4) {
+		t.Errorf("Expected 25%% failures to exceed MaxFailurePercent=20")
+	}
+	if (&RolloutStrategy{}).exceeded(summary, 4) {
+		t.Errorf("Expected no threshold to never be exceeded")
+	}
+
+	// 批次中第一台完成的主机失败时按整个批次计算
+	first := &BatchSummary{Failed: []string{"h1"}}
+	if (&RolloutStrategy{MaxFailurePercent: 20}).exceeded(first, 10) {
+		t.Errorf("Expected 1 failure of 10 hosts not to exceed MaxFailurePercent=20")
+	}
+	if !(&RolloutStrategy{MaxFailurePercent: 20}).exceeded(first, 1) {
+		t.Errorf("Expected a failed canary to exceed MaxFailurePercent=20")
+	}
+}
+
+func newTestHosts(t *testing.T, s *Server, n int) []string {
+	var hosts []string
+	for i := 0; i < n; i++ {
+		c := newTestClient(t, s, withMachineID(fmt.Sprintf("%s-%d", t.Name(), i)))
+		hosts = append(hosts, c.MachineID)
+	}
+	return hosts
+}
+
+func TestBatchPauseResume(t *testing.T) {
+	s := newTestServer(t)
+	hosts := newTestHosts(t, s, 3)
+
+	b := s.RunBatch(context.Background(), hosts, &ScriptTaskRequest{Content: "sleep 0.1"}, BatchOptions{
+		Strategy: &RolloutStrategy{BatchSize: 1, Pause: 100 * time.Millisecond},
+	})
+	<-b.Results()
+	b.Pause()
+	if state := b.Progress().State; state != BatchPaused {
+		t.Fatalf("Expected state %s, but got %s", BatchPaused, state)
+	}
+	time.Sleep(300 * time.Millisecond)
+	// 暂停前已开始的主机可能执行完，但不会再开始新的主机
+	if summary := b.Summary(); summary.Done() > 2 {
+		t.Errorf("Expected no hosts to start while paused, but %d are done", summary.Done())
+	}
+
+	b.Resume()
+	summary := b.Wait()
+	if len(summary.Succeeded) != len(hosts) {
+		t.Errorf("Expected all hosts to succeed after resume, but got %+v", summary)
+	}
+	if state := b.Progress().State; state != BatchCompleted {
+		t.Errorf("Expected state %s, but got %s", BatchCompleted, state)
+	}
+}
+
+func TestBatchAbort(t *testing.T) {
+	s := newTestServer(t)
+	hosts := newTestHosts(t, s, 3)
+
+	b := s.RunBatch(context.Background(), hosts, &ScriptTaskRequest{Content: "exit 0"}, BatchOptions{
+		Strategy: &RolloutStrategy{Canary: 1, Pause: time.Minute},
+	})
+	<-b.Results()
+	b.Abort("stopped by operator")
+	summary := b.Wait()
+
+	progress := b.Progress()
+	if progress.State != BatchAborted || progress.AbortReason != "stopped by operator" {
+		t.Errorf("Expected batch to be aborted by operator, but got %+v", progress)
+	}
+	if len(summary.Succeeded) != 1 || len(summary.Skipped) != 2 {
+		t.Errorf("Expected 1 host to succeed and 2 to be skipped, but got %+v", summary)
+	}
+
+	// 已结束的批量执行不能再被中止
+	b = s.RunBatch(context.Background(), hosts[:1], &ScriptTaskRequest{Content: "exit 0"}, BatchOptions{})
+	b.Wait()
+	b.Abort("too late")
+	if state := b.Progress().State; state != BatchCompleted {
+		t.Errorf("Expected state %s, but got %s", BatchCompleted, state)
+	}
+}
+
+func TestBatchFailureThreshold(t *testing.T) {
+	s := newTestServer(t)
+	hosts := newTestHosts(t, s, 3)
+
+	b := s.RunBatch(context.Background(), hosts, &ScriptTaskRequest{Content: "exit 3"}, BatchOptions{
+		Strategy: &RolloutStrategy{Canary: 1, MaxFailurePercent: 50},
+	})
+	summary := b.Wait()
+	progress := b.Progress()
+	if progress.State != BatchAborted || progress.AbortReason != "failure threshold exceeded" {
+		t.Errorf("Expected batch to be aborted by the failure threshold, but got %+v", progress)
+	}
+	if len(summary.Failed) != 1 || len(summary.Skipped) != 2 {
+		t.Errorf("Expected the canary to fail and 2 hosts to be skipped, but got %+v", summary)
+	}
+}
+
+func TestRunBatchMaxInFlight(t *testing.T) {
+	s := newTestServer(t)
+	var clients []*Client
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		c := newTestClient(t, s, withMachineID(fmt.Sprintf("%s-%d", t.Name(), i)))
+		clients = append(clients, c)
+		hosts = append(hosts, c.MachineID)
+	}
+
+	var maxRunning int32
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			running := 0
+			for _, c := range clients {
+				running += c.ExecutorStats().Running
+			}
+			if n := int32(running); n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+		}
+	}()
+
+	b := s.RunBatch(context.Background(), hosts, &ScriptTaskRequest{Content: "sleep 0.2"}, BatchOptions{MaxInFlight: 2})
+	summary := b.Wait()
+	close(stop)
+	<-sampled
+
+	if len(summary.Succeeded) != len(hosts) {
+		t.Errorf("Expected %d hosts to succeed, but got %+v", len(hosts), summary)
+	}
+	if n := atomic.LoadInt32(&maxRunning); n != 2 {
+		t.Errorf("Expected at most 2 scripts running at once, but got %d", n)
+	}
+}
+
+func TestRunBatchResults(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+
+	b := s.RunBatch(context.Background(), []string{c.MachineID, "unknown"}, &ScriptTaskRequest{Content: "echo failed; exit 3"}, BatchOptions{})
+	results := make(map[string]*HostResult)
+	for hr := range b.Results() {
+		results[hr.MachineID] = hr
+	}
+
+	hr := results[c.MachineID]
+	if hr == nil || hr.Status != HostFailed {
+		t.Fatalf("Expected %s to fail, but got %+v", c.MachineID, hr)
+	}
+	if hr.Result == nil || hr.Result.ExitCode != 3 || hr.Result.Stdout != "failed\n" {
+		t.Errorf("Expected the script result with exit code 3, but got %+v", hr.Result)
+	}
+	if hr.StartTime.IsZero() || hr.EndTime.Before(hr.StartTime) {
+		t.Errorf("Expected start and end time to be set, but got %s - %s", hr.StartTime, hr.EndTime)
+	}
+	hr = results["unknown"]
+	if hr == nil || hr.Status != HostUnreachable || !errors.Is(hr.Err, ErrClientNotFound) {
+		t.Errorf("Expected unknown host to be unreachable, but got %+v", hr)
+	}
+
+	summary := b.Wait()
+	expected := BatchSummary{Total: 2, Failed: []string{c.MachineID}, Unreachable: []string{"unknown"}}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("Expected summary %+v, but got %+v", expected, summary)
+	}
+	if summary.Done() != 2 {
+		t.Errorf("Expected 2 hosts done, but got %d", summary.Done())
+	}
+}
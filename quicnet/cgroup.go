@@ -0,0 +1,70 @@
+package quicnet
+
+import (
+	"time"
+)
+
+const (
+	defaultCgroupSlice = "lops.slice"
+	cgroupCPUPeriod    = 100000
+)
+
+// CgroupLimits 为脚本所在 cgroup 的资源上限，0 表示不限制。
+// 只在 Linux 且启用 cgroup v2 时可用，无法设置时任务以 CodeCgroupUnavailable 失败
+type CgroupLimits struct {
+	// MemoryMax 为内存上限的字节数，设置后同时禁止使用 swap
+	MemoryMax uint64 `json:"memory_max,omitempty"`
+	// CPUWeight 为 CPU 权重，取值 1-10000，默认为 100
+	CPUWeight uint64 `json:"cpu_weight,omitempty"`
+	// CPUQuota 为最多可以使用的 CPU 数，例如 0.5 表示半个 CPU
+	CPUQuota float64 `json:"cpu_quota,omitempty"`
+	PidsMax  uint64  `json:"pids_max,omitempty"`
+	// IOWeight 为 IO 权重，取值 1-10000，默认为 100
+	IOWeight uint64 `json:"io_weight,omitempty"`
+}
+
+func (l *CgroupLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.CPUWeight > 10000 {
+		return newScriptError(CodeInvalidOptions, "cpu weight %d out of range 1-10000", l.CPUWeight)
+	}
+	if l.IOWeight > 10000 {
+		return newScriptError(CodeInvalidOptions, "io weight %d out of range 1-10000", l.IOWeight)
+	}
+	if l.CPUQuota < 0 {
+		return newScriptError(CodeInvalidOptions, "invalid cpu quota %g", l.CPUQuota)
+	}
+	return nil
+}
+
+// ResourceUsage 为脚本所在 cgroup 的资源使用情况
+type ResourceUsage struct {
+	// MemoryPeak 为内存使用的峰值，内核不支持 memory.peak 时为 0
+	MemoryPeak uint64
+	CPUUser    time.Duration
+	CPUSystem  time.Duration
+	// OOMKills 为因超过内存上限被结束的进程数
+	OOMKills uint64
+}
+
+// newTaskCgroup 为任务创建 cgroup。cgroup v2 不可用时，未请求资源上限的任务返回 nil，
+// 脚本在 cgroup 之外运行且不统计资源使用，请求了资源上限的任务返回错误
+func newTaskCgroup(task *ScriptTask) (*taskCgroup, error) {
+	if err := task.Cgroup.validate(); err != nil {
+		return nil, err
+	}
+	slice := task.CgroupSlice
+	if slice == "" {
+		slice = defaultCgroupSlice
+	}
+	cg, err := createTaskCgroup(slice, task.TaskID, task.Cgroup)
+	if err != nil {
+		if task.Cgroup != nil {
+			return nil, newScriptError(CodeCgroupUnavailable, "cannot apply cgroup limits: %s", err)
+		}
+		return nil, nil
+	}
+	return cg, nil
+}
@@ -0,0 +1,307 @@
+//go:build linux
+// +build linux
+
+package quicnet
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+var errCgroupV2Unavailable = errors.New("cgroup v2 is not available")
+
+// cgroupControllers 为在 slice 中为任务启用的控制器
+var cgroupControllers = []string{"memory", "cpu", "pids", "io"}
+
+var (
+	cgroupSlicesMu sync.Mutex
+	cgroupSlices   = make(map[string]error)
+
+	cgroupFDOnce      sync.Once
+	cgroupFDSupported bool
+)
+
+// taskCgroup 为任务独占的 cgroup，位于 agent 的 slice 之下
+type taskCgroup struct {
+	path string
+	dir  *os.File
+	// lateAttach 表示内核不支持在创建进程时指定 cgroup，脚本启动后再移入
+	lateAttach bool
+}
+
+// setupSlice 创建 agent 的 slice 并为其子 cgroup 启用控制器，每个 slice 只尝试一次
+func setupSlice(slice string) (string, error) {
+	path := filepath.Join(cgroupRoot, slice)
+	cgroupSlicesMu.Lock()
+	defer cgroupSlicesMu.Unlock()
+	if err, ok := cgroupSlices[slice]; ok {
+		return path, err
+	}
+	err := createSlice(path)
+	cgroupSlices[slice] = err
+	return path, err
+}
+
+func createSlice(path string) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return errCgroupV2Unavailable
+	}
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	available, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, c := range cgroupControllers {
+		if containsString(strings.Fields(string(available)), c) {
+			enable = append(enable, "+"+c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	// 控制器需从根 cgroup 逐级启用，slice 中不能有进程
+	for _, dir := range []string{cgroupRoot, path} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createTaskCgroup(slice, taskID string, limits *CgroupLimits) (*taskCgroup, error) {
+	slicePath, err := setupSlice(slice)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(slicePath, "task-"+cgroupName(taskID))
+	if err := os.Mkdir(path, 0755); os.IsExist(err) {
+		// agent 异常退出时可能留下空的 cgroup
+		os.Remove(path)
+		err = os.Mkdir(path, 0755)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	cg := &taskCgroup{path: path}
+	if err := cg.apply(limits); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if cg.dir, err = os.Open(path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return cg, nil
+}
+
+func cgroupName(taskID string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, taskID)
+}
+
+func (cg *taskCgroup) apply(limits *CgroupLimits) error {
+	if limits == nil {
+		return nil
+	}
+	if limits.MemoryMax > 0 {
+		if err := writeCgroupFile(cg.path, "memory.max", strconv.FormatUint(limits.MemoryMax, 10)); err != nil {
+			return err
+		}
+		// 未启用 swap 的系统没有 memory.swap.max
+		writeCgroupFile(cg.path, "memory.swap.max", "0")
+	}
+	if limits.CPUWeight > 0 {
+		if err := writeCgroupFile(cg.path, "cpu.weight", strconv.FormatUint(limits.CPUWeight, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.CPUQuota > 0 {
+		quota := int64(limits.CPUQuota * cgroupCPUPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+		if err := writeCgroupFile(cg.path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			return err
+		}
+	}
+	if limits.PidsMax > 0 {
+		if err := writeCgroupFile(cg.path, "pids.max", strconv.FormatUint(limits.PidsMax, 10)); err != nil {
+			return err
+		}
+	}
+	if limits.IOWeight > 0 {
+		if err := writeCgroupFile(cg.path, "io.weight", "default "+strconv.FormatUint(limits.IOWeight, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attach 使脚本进程在创建时即位于该 cgroup 中。这需要 Linux 5.7 以上，
+// 更早的内核上由 started 在脚本启动后将其移入
+func (cg *taskCgroup) attach(cmd *exec.Cmd) {
+	cgroupFDOnce.Do(func() {
+		cgroupFDSupported = kernelAtLeast(5, 7)
+	})
+	if !cgroupFDSupported {
+		cg.lateAttach = true
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+}
+
+// started 将已启动的脚本移入 cgroup，脚本在移入前创建的子进程不在 cgroup 中
+func (cg *taskCgroup) started(pid int) error {
+	if !cg.lateAttach {
+		return nil
+	}
+	if err := writeCgroupFile(cg.path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return newScriptError(CodeCgroupUnavailable, "move script into cgroup %s: %s", cg.path, err)
+	}
+	return nil
+}
+
+// close 结束 cgroup 中残留的进程并删除 cgroup，返回脚本的资源使用情况
+func (cg *taskCgroup) close() *ResourceUsage {
+	cg.dir.Close()
+	usage := cg.usage()
+	deadline := time.Now().Add(time.Second)
+	for {
+		// 脱离进程组的后台进程仍在 cgroup 中
+		if len(cg.pids()) > 0 {
+			cg.kill()
+		}
+		err := os.Remove(cg.path)
+		if err == nil || os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Failed to remove cgroup %s: %s", cg.path, err)
+			break
+		}
+		time.Sleep(groupPollInterval)
+	}
+	return usage
+}
+
+func (cg *taskCgroup) pids() []int {
+	data, _ := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// kill 结束 cgroup 中的所有进程，内核不支持 cgroup.kill（5.14 以前）时逐个结束 cgroup.procs 中的进程
+func (cg *taskCgroup) kill() {
+	if writeCgroupFile(cg.path, "cgroup.kill", "1") == nil {
+		return
+	}
+	cg.killProcs()
+}
+
+func (cg *taskCgroup) killProcs() {
+	for _, pid := range cg.pids() {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+func (cg *taskCgroup) usage() *ResourceUsage {
+	usage := &ResourceUsage{}
+	if data, err := os.ReadFile(filepath.Join(cg.path, "memory.peak")); err == nil {
+		usage.MemoryPeak, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	cpu := readCgroupStat(filepath.Join(cg.path, "cpu.stat"))
+	usage.CPUUser = time.Duration(cpu["user_usec"]) * time.Microsecond
+	usage.CPUSystem = time.Duration(cpu["system_usec"]) * time.Microsecond
+	usage.OOMKills = readCgroupStat(filepath.Join(cg.path, "memory.events"))["oom_kill"]
+	return usage
+}
+
+// readCgroupStat 读取 cpu.stat、memory.events 等每行为 "key value" 的文件
+func readCgroupStat(path string) map[string]uint64 {
+	stats := make(map[string]uint64)
+	f, err := os.Open(path)
+	if err != nil {
+		return stats
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			stats[key] = n
+		}
+	}
+	return stats
+}
+
+// kernelAtLeast 判断运行中的内核版本是否不低于 major.minor
+func kernelAtLeast(major, minor int) bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return releaseAtLeast(string(release), major, minor)
+}
+
+// releaseAtLeast 解析 "5.15.0-91-generic" 形式的内核版本
+func releaseAtLeast(release string, major, minor int) bool {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	// 次版本号之后可能直接跟着 "-rc1" 等后缀
+	digits := parts[1]
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+	rel, _ := strconv.Atoi(digits)
+	return maj > major || maj == major && rel >= minor
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
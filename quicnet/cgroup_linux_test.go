@@ -0,0 +1,159 @@
+//go:build linux
+// +build linux
+
+package quicnet
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCgroupStat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpu.stat")
+	if err := os.WriteFile(path, []byte("usage_usec 300\nuser_usec 200\nsystem_usec 100\nbad\n"), 0644); err != nil {
+		t.Fatalf("Failed to write cpu.stat: %s", err)
+	}
+	stats := readCgroupStat(path)
+	if stats["user_usec"] != 200 || stats["system_usec"] != 100 || len(stats) != 3 {
+		t.Fatalf("Expected three stats with user_usec 200 and system_usec 100, but got %v", stats)
+	}
+	if stats := readCgroupStat(filepath.Join(t.TempDir(), "missing")); len(stats) != 0 {
+		t.Fatalf("Expected no stats, but got %v", stats)
+	}
+}
+
+func TestRunScriptInvalidCgroupLimits(t *testing.T) {
+	task := &ScriptTask{
+		TaskID:       "invalid-cgroup",
+		Content:      "echo hi",
+		Timeout:      time.Second,
+		Cgroup:       &CgroupLimits{CPUWeight: 20000},
+		ScriptResult: &ScriptResult{},
+	}
+	NewCmdRunner().RunScript(task)
+	if task.ScriptResult.Code != CodeInvalidOptions {
+		t.Fatalf("Expected %s, but got %s", CodeInvalidOptions, task.ScriptResult.Code)
+	}
+}
+
+func TestRunScriptCgroup(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		t.Skip("cgroup v2 is not available")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating cgroups requires root")
+	}
+	slice := "lops-test.slice"
+	defer os.Remove(filepath.Join(cgroupRoot, slice))
+	task := &ScriptTask{
+		TaskID:       "cgroup",
+		Content:      "cat /proc/self/cgroup",
+		Timeout:      5 * time.Second,
+		Cgroup:       &CgroupLimits{MemoryMax: 64 << 20, PidsMax: 16},
+		CgroupSlice:  slice,
+		ScriptResult: &ScriptResult{},
+	}
+	NewCmdRunner().RunScript(task)
+	r := task.ScriptResult
+	if r.Code != CodeSuccess {
+		t.Fatalf("Expected success, but got %s: %s", r.Code, r.Error)
+	}
+	if want := "/" + slice + "/task-cgroup\n"; !strings.HasSuffix(r.Stdout, want) {
+		t.Fatalf("Expected the script to run in %s, but got %q", want, r.Stdout)
+	}
+	if r.Usage == nil {
+		t.Fatalf("Expected resource usage, but got none")
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, slice, "task-cgroup")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the task cgroup to be removed, but got %v", err)
+	}
+}
+
+func TestReleaseAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		release string
+		want    bool
+	}{
+		{"5.7.0", true},
+		{"5.15.0-91-generic", true},
+		{"6.1.0", true},
+		{"5.6.19", false},
+		{"4.19.0", false},
+		{"5.7-rc1", true},
+		{"invalid", false},
+	} {
+		if got := releaseAtLeast(tc.release, 5, 7); got != tc.want {
+			t.Errorf("Expected releaseAtLeast(%q, 5, 7) to be %v, but got %v", tc.release, tc.want, got)
+		}
+	}
+}
+
+func TestRunScriptCgroupUnavailable(t *testing.T) {
+	task := &ScriptTask{
+		TaskID:       "cgroup-unavailable",
+		Content:      "echo hi",
+		Timeout:      time.Second,
+		Cgroup:       &CgroupLimits{MemoryMax: 64 << 20},
+		CgroupSlice:  "lops-missing-parent/lops.slice",
+		ScriptResult: &ScriptResult{},
+	}
+	NewCmdRunner().RunScript(task)
+	if task.ScriptResult.Code != CodeCgroupUnavailable || task.ScriptResult.Stdout != "" {
+		t.Errorf("Expected the script not to run without its cgroup limits, but got %s: %q", task.ScriptResult.Code, task.ScriptResult.Stdout)
+	}
+
+	// 未请求资源上限时在 cgroup 之外运行
+	task = &ScriptTask{
+		TaskID:       "cgroup-optional",
+		Content:      "echo hi",
+		Timeout:      time.Second,
+		CgroupSlice:  "lops-missing-parent/lops.slice",
+		ScriptResult: &ScriptResult{},
+	}
+	NewCmdRunner().RunScript(task)
+	if task.ScriptResult.Code != CodeSuccess {
+		t.Errorf("Expected the script to run without a cgroup, but got %s: %s", task.ScriptResult.Code, task.ScriptResult.Error)
+	}
+}
+
+func TestTaskCgroupFallbacks(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		t.Skip("cgroup v2 is not available")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("creating cgroups requires root")
+	}
+	slice := "lops-test.slice"
+	defer os.Remove(filepath.Join(cgroupRoot, slice))
+	cg, err := createTaskCgroup(slice, "fallback", nil)
+	if err != nil {
+		t.Fatalf("Failed to create cgroup: %s", err)
+	}
+
+	// 模拟不支持 CgroupFD 的内核：启动后再移入 cgroup
+	cg.lateAttach = true
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process: %s", err)
+	}
+	if err := cg.started(cmd.Process.Pid); err != nil {
+		t.Fatalf("Expected the process to be moved into the cgroup, but got %s", err)
+	}
+	if pids := cg.pids(); len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Errorf("Expected cgroup to contain %d, but got %v", cmd.Process.Pid, pids)
+	}
+
+	// 模拟不支持 cgroup.kill 的内核：逐个结束进程
+	cg.killProcs()
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("Expected the process to be killed")
+	}
+	cg.close()
+	if _, err := os.Stat(cg.path); !os.IsNotExist(err) {
+		t.Errorf("Expected the task cgroup to be removed, but got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package quicnet
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// taskCgroup 在 Linux 以外的系统上不可用
+type taskCgroup struct{}
+
+func createTaskCgroup(slice, taskID string, limits *CgroupLimits) (*taskCgroup, error) {
+	return nil, errors.New("cgroups are only supported on linux")
+}
+
+func (cg *taskCgroup) attach(cmd *exec.Cmd) {}
+
+func (cg *taskCgroup) started(pid int) error {
+	return nil
+}
+
+func (cg *taskCgroup) close() *ResourceUsage {
+	return nil
+}
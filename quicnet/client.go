@@ -1,14 +1,16 @@
 package quicnet
 
 import (
-	"context"
 	"crypto/tls"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/denisbrodbeck/machineid"
@@ -16,44 +18,74 @@ import (
 	quic "github.com/quic-go/quic-go"
 )
 
-type Client struct {
-	tlsCfg     *tls.Config
-	quicCfg    *quic.Config
-	serverAddr string
+const clientMessageWorkers = 4
+
+var ErrClientClosed = errors.New("client closed")
 
+type Client struct {
+	tlsCfg        *tls.Config
+	quicCfg       *quic.Config
+	serverAddr    string
+	serverAddrs   []string
+	nextAddr      int
+	backoff       Backoff
+	connStateFunc ConnStateFunc
+
+	// connMu 保护 session、stream 等重连时会替换的字段
+	connMu         sync.RWMutex
+	connState      ConnState
 	session        quic.Connection
 	stream         quic.Stream
+	peer           *Capabilities
 	tm             *TaskManager
+	executor       *executor
 	msg            chan *Message
 	messageHandler *MessageHandler
+	rpc            *rpcState
+	spoolCfg       *SpoolConfig
+	spool          *Spool
+	taskLog        *taskRunLog
+	seen           *dedupeWindow
+	taskRuns       *dedupeWindow
+	onAck          func(id string)
+	renewer        *certRenewer
+	codecs         []string
+	maxFrameSize   int
+	compression    bool
+	stats          *frameStats
+	deliver        func(msg *Message) // 将非控制消息交给 MessageHandler
+	streams        map[int64]*msgStream
+	streamsMu      sync.Mutex
+	done           chan struct{}
+	closeOnce      sync.Once
 
 	MachineID string
 	Hostname  string
 	IP        string
-}
-
-func NewClient(serverAddr string, tlsCfg *tls.Config, quicCfg *quic.Config) (*Client, error) {
-	session, err := quic.DialAddr(serverAddr, tlsCfg, quicCfg)
-	if err != nil {
-		return nil, err
-	}
+	Labels    map[string]string
+	Facts     map[string]string
+	// Identity 为服务端连接上已校验的客户端证书身份，未使用客户端证书时为 nil
+	Identity *PeerIdentity
 
-	stream, err := session.OpenStreamSync(context.Background())
-	if err != nil {
-		return nil, err
-	}
+	presence presence
+}
 
-	udpAddr := getLocalIP(session)
-	if udpAddr == nil {
+type ClientOption func(*Client)
 
+// WithLabels 设置 agent 通过心跳上报的标签，服务端可用 Selector 按标签选择 agent
+func WithLabels(labels map[string]string) ClientOption {
+	return func(c *Client) {
+		c.Labels = labels
 	}
+}
 
+func NewClient(serverAddr string, tlsCfg *tls.Config, quicCfg *quic.Config, opts ...ClientOption) (*Client, error) {
 	machineID, err := machineid.ID()
 	if err != nil {
 		return nil, err
 	}
 
-	hostname, err := machineid.Hostname()
+	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
@@ -62,160 +94,354 @@ func NewClient(serverAddr string, tlsCfg *tls.Config, quicCfg *quic.Config) (*Cl
 		tlsCfg:         tlsCfg,
 		quicCfg:        quicCfg,
 		serverAddr:     serverAddr,
-		IP:             udpAddr.IP.String(),
+		serverAddrs:    []string{serverAddr},
+		backoff:        DefaultBackoff,
 		MachineID:      machineID,
-		session:        session,
-		stream:         stream,
 		Hostname:       hostname,
 		tm:             NewTaskManager(),
+		executor:       newExecutor(ExecutorConfig{}),
 		msg:            make(chan *Message, 100),
 		messageHandler: NewMessageHandler(100),
+		rpc:            newRPCState(),
+		seen:           newDedupeWindow(defaultDedupeWindow),
+		taskRuns:       newDedupeWindow(defaultDedupeWindow),
+		done:           make(chan struct{}),
+		maxFrameSize:   defaultMaxFrameSize,
+		compression:    true,
+		stats:          newFrameStats(),
+		Facts:          collectFacts(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if err := c.backoff.validate(); err != nil {
+		return nil, err
+	}
+	if c.renewer != nil {
+		if c.tlsCfg, err = c.renewer.tlsConfig(c.tlsCfg); err != nil {
+			return nil, err
+		}
+	}
+	if c.spoolCfg != nil {
+		if c.spool, err = OpenSpool(*c.spoolCfg); err != nil {
+			return nil, err
+		}
+		// 执行过的任务与磁盘队列保存在同一目录，重启后重复下发的任务不会再次执行
+		if c.taskLog, err = openTaskRunLog(c.spoolCfg.Dir, defaultDedupeWindow); err != nil {
+			c.spool.Close()
+			return nil, err
+		}
+		c.taskLog.restore(c.taskRuns)
+	}
+	c.deliver = func(msg *Message) {
+		// 脚本任务由执行器排队并限制并发，不占用消息处理 worker，
+		// 否则长时间运行的任务会阻塞任务查询和取消
+		if msg.Type == "script_task" && !msg.IsReply() {
+			go c.messageHandler.handle(msg, c)
+			return
+		}
+		c.messageHandler.SubmitMessage(msg)
+	}
+	// 握手时向服务端声明已注册的消息类型，需在连接前注册
 	c.messageHandler.RegisterHandler("script_task", HandlerScriptTask)
+	c.messageHandler.RegisterHandler(msgTypeTaskCancel, HandlerTaskCancel)
+	c.messageHandler.RegisterHandler(msgTypeTaskStatus, HandlerTaskStatus)
+	if err := c.connectAny(); err != nil {
+		if c.spool != nil {
+			c.spool.Close()
+			c.taskLog.Close()
+		}
+		return nil, err
+	}
+	c.messageHandler.HandleMessages(c, clientMessageWorkers)
 	go c.prosessMsg()
 	go c.run()
-	go c.StartHeartbeat(60 * time.Second)
+	// 首个心跳先于磁盘队列中的消息发出，服务端据此确认补发的结果来自任务所下发的 agent
+	c.StartHeartbeat(60 * time.Second)
+	go c.flushSpool()
+	if c.renewer != nil {
+		go c.renewLoop()
+	}
 	return c, nil
 }
 
 func (c *Client) Close() {
-	c.stream.Close()
-	c.session.CloseWithError(0, "")
-	close(c.msg)
+	c.CloseWithError(CloseNormal, "")
 }
 
+// CloseWithError 以应用错误码关闭连接，对端可据此得知关闭原因
+func (c *Client) CloseWithError(code quic.ApplicationErrorCode, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.rpc.cancelAll()
+		c.connMu.RLock()
+		defer c.connMu.RUnlock()
+		c.stream.Close()
+		c.session.CloseWithError(code, reason)
+		if c.spool != nil {
+			c.spool.Close()
+			c.taskLog.Close()
+		}
+	})
+}
+
+// Done 在连接关闭后返回一个已关闭的 channel
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) IsClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendMsg 发送消息，属于独占流的消息直接写入该流，流已关闭时改走控制流
 func (c *Client) SendMsg(msg *Message) error {
-	c.msg <- msg
-	return nil
+	if msg.stream != nil {
+		if err := msg.stream.writeMessage(msg); err == nil {
+			return nil
+		}
+	}
+	select {
+	case c.msg <- msg:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	}
 }
 
 func (c *Client) prosessMsg() {
-	for msg := range c.msg {
-		data, err := json.Marshal(msg)
-		if err != nil {
-			continue
+	for {
+		select {
+		case msg := <-c.msg:
+			err := c.WriteMessage(msg)
+			var tooLarge *FrameTooLargeError
+			if errors.As(err, &tooLarge) && msg.IsReply() && msg.Error == "" {
+				// 超过对端上限的回复永远不会被确认，改用同一 ID 回复错误，使对端的请求结束并清除磁盘队列中的记录
+				log.Printf("Reply %s to %s is too large, replying with an error: %s", msg.ID, msg.ReplyTo, err)
+				err = c.WriteMessage(&Message{
+					ID:      msg.ID,
+					Type:    msg.Type,
+					ReplyTo: msg.ReplyTo,
+					NeedAck: msg.NeedAck,
+					Code:    ErrCodeFrameTooLarge,
+					Error:   err.Error(),
+				})
+			}
+			if err != nil {
+				log.Printf("Failed to write message %s: %s", msg.ID, err)
+			}
+		case <-c.done:
+			return
 		}
-		c.Write(data)
 	}
 }
 
 func (c *Client) run() {
 	for {
-		data, err := c.Read()
+		msg, err := c.ReadMessage()
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			log.Printf("Failed to unmarshal message: %s", err)
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
-				// Connection is closed, try to reconnect
-				if err := c.Reconnect(); err != nil {
-					// Handle error
-					log.Printf("Failed to reconnect: %v", err)
-					time.Sleep(time.Second * 5) // Wait before next attempt
-					continue
-				}
-			} else {
-				// Other error, handle as you wish
-				continue
+			if c.IsClosed() {
+				return
+			}
+			// 任何读错误都意味着当前连接不可用，重连成功前不再读取
+			if !c.reconnectLoop(err) {
+				return
 			}
+			continue
 		}
-		var msg Message
-		err = json.Unmarshal(data, &msg)
-		if err != nil {
+		if c.handleIncoming(msg) {
 			continue
 		}
-		c.messageHandler.SubmitMessage(&msg)
+		c.deliver(msg)
 	}
 }
 
+// connView 为当前连接上收发消息所需的参数，重连时一起替换
+type connView struct {
+	stream quic.Stream
+	codec  Codec
+	read   frameOptions
+	write  frameOptions
+}
+
+func (c *Client) currentConn() (*connView, error) {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if c.stream == nil || c.connState != StateConnected {
+		return nil, ErrNotConnected
+	}
+	cv := &connView{
+		stream: c.stream,
+		codec:  JSONCodec,
+		read:   frameOptions{maxSize: c.maxFrameSize, stats: c.stats},
+		write:  frameOptions{stats: c.stats},
+	}
+	if c.peer != nil {
+		if c.peer.codec != nil {
+			cv.codec = c.peer.codec
+		}
+		cv.write.maxSize = c.peer.MaxFrameSize
+		cv.write.compress = c.compression && containsString(c.peer.Compression, compressionGzip)
+	}
+	return cv, nil
+}
+
+// DecodeError 表示收到的帧无法解码为 Message，连接本身仍然可用
+type DecodeError struct {
+	Codec string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %s message: %s", e.Codec, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// WriteMessage 使用连接协商的编码发送消息
+func (c *Client) WriteMessage(msg *Message) error {
+	cv, err := c.currentConn()
+	if err != nil {
+		return err
+	}
+	data, err := cv.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = writePacket(cv.stream, data, cv.write)
+	return err
+}
+
+// ReadMessage 读取并解码一条消息
+func (c *Client) ReadMessage() (*Message, error) {
+	cv, err := c.currentConn()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readPacket(cv.stream, cv.read)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := cv.codec.Unmarshal(data)
+	if err != nil {
+		return nil, &DecodeError{Codec: cv.codec.Name(), Err: err}
+	}
+	return msg, nil
+}
+
 func (c *Client) Write(data []byte) (int, error) {
-	return writePacket(c.stream, data)
+	cv, err := c.currentConn()
+	if err != nil {
+		return 0, err
+	}
+	return writePacket(cv.stream, data, cv.write)
 }
 
 func (c *Client) Read() ([]byte, error) {
-	return readPacket(c.stream)
+	cv, err := c.currentConn()
+	if err != nil {
+		return nil, err
+	}
+	return readPacket(cv.stream, cv.read)
 }
 
 type HeartbeatData struct {
-	MachineID string `json:"machine_id"`
-	Hostname  string `json:"hostname"`
-	IP        string `json:"ip"`
+	MachineID string            `json:"machine_id"`
+	Hostname  string            `json:"hostname"`
+	IP        string            `json:"ip"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Facts     map[string]string `json:"facts,omitempty"`
 }
 
 func (c *Client) StartHeartbeat(interval time.Duration) {
+	// 连接建立后立即发送一次心跳，服务端以首个心跳完成注册
+	c.sendHeartbeat()
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			heartbeatData := HeartbeatData{
-				MachineID: c.MachineID,
-				Hostname:  c.Hostname,
-				IP:        c.IP,
+		for {
+			select {
+			case <-ticker.C:
+				c.sendHeartbeat()
+			case <-c.done:
+				return
 			}
-
-			data, err := json.Marshal(heartbeatData)
-			if err != nil {
-				fmt.Println("Failed to marshal heartbeat data:", err)
-				continue
-			}
-
-			msg := Message{
-				ID:   uuid.New().String(),
-				Type: "heartbeat",
-				Data: data,
-			}
-
-			c.SendMsg(&msg)
 		}
 	}()
 }
 
-func (c *Client) Reconnect() error {
-	session, err := quic.DialAddr(c.serverAddr, c.tlsCfg, c.quicCfg)
-	if err != nil {
-		return err
+func (c *Client) sendHeartbeat() {
+	c.connMu.RLock()
+	ip := c.IP
+	c.connMu.RUnlock()
+
+	heartbeatData := HeartbeatData{
+		MachineID: c.MachineID,
+		Hostname:  c.Hostname,
+		IP:        ip,
+		Labels:    c.Labels,
+		Facts:     c.Facts,
 	}
 
-	stream, err := session.OpenStreamSync(context.Background())
+	data, err := json.Marshal(heartbeatData)
 	if err != nil {
-		return err
+		fmt.Println("Failed to marshal heartbeat data:", err)
+		return
 	}
 
-	c.session = session
-	c.stream = stream
-	return nil
-}
+	msg := Message{
+		ID:   uuid.New().String(),
+		Type: "heartbeat",
+		Data: data,
+	}
 
-func writePacket(stream quic.Stream, data []byte) (int, error) {
-	packetLength := uint32(len(data))
-	lengthBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBytes, packetLength)
+	c.SendMsg(&msg)
+}
 
-	n1, err := stream.Write(lengthBytes)
-	if err != nil {
-		return n1, err
+func collectFacts() map[string]string {
+	return map[string]string{
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"num_cpu": strconv.Itoa(runtime.NumCPU()),
 	}
-	n2, err := stream.Write(data)
-	return n1 + n2, err
 }
 
-func readPacket(stream quic.Stream) ([]byte, error) {
-	lengthBytes := make([]byte, 4)
-	_, err := io.ReadFull(stream, lengthBytes)
-	if err != nil {
-		return nil, err
-	}
+// Attributes 返回 Selector 匹配使用的属性：标签、自动采集的主机信息以及 machine_id、hostname、ip
+func (c *Client) Attributes() map[string]string {
+	return makeAttributes(c.Labels, c.Facts, c.MachineID, c.Hostname, c.IP)
+}
 
-	packetLength := binary.BigEndian.Uint32(lengthBytes)
-	data := make([]byte, packetLength)
-	_, err = io.ReadFull(stream, data)
-	return data, err
+func makeAttributes(labels, facts map[string]string, machineID, hostname, ip string) map[string]string {
+	attrs := make(map[string]string, len(labels)+len(facts)+3)
+	for k, v := range facts {
+		attrs[k] = v
+	}
+	for k, v := range labels {
+		attrs[k] = v
+	}
+	attrs["machine_id"] = machineID
+	attrs["hostname"] = hostname
+	attrs["ip"] = ip
+	return attrs
 }
 
-func getLocalIP(session quic.Session) *net.UDPAddr {
-	udpConn := session.ConnectionState().UDPConn
-	if udpConn == nil {
+func getLocalIP(session quic.Connection) *net.UDPAddr {
+	localAddr, ok := session.LocalAddr().(*net.UDPAddr)
+	if !ok {
 		return nil
 	}
-
-	localAddr := udpConn.LocalAddr().(*net.UDPAddr)
 	return localAddr
 }
@@ -2,24 +2,42 @@ package quicnet
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type ClientManager struct {
-	clients map[string]*Client
-	mu      sync.RWMutex
+	clients     map[string]*Client
+	mu          sync.RWMutex
+	presenceCfg PresenceConfig
+
+	subscribers map[chan PresenceEvent]struct{}
+	subMu       sync.Mutex
+
+	keys       *KeyStore
+	autoAccept AutoAcceptFunc
+
+	// onEvict 在 agent 记录被 sweeper 移除后调用
+	onEvict func(client *Client)
 }
 
 func NewClientManager() *ClientManager {
 	return &ClientManager{
-		clients: make(map[string]*Client),
+		clients:     make(map[string]*Client),
+		presenceCfg: PresenceConfig{}.withDefaults(),
+		subscribers: make(map[chan PresenceEvent]struct{}),
 	}
 }
 
 func (cm *ClientManager) AddClient(client *Client) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	now := time.Now()
+	client.presence = presence{state: PresenceOnline, connectedAt: now, lastSeen: now}
 	cm.clients[client.MachineID] = client
+	cm.mu.Unlock()
+
+	cm.emit(EventConnect, client)
 }
 
 func (cm *ClientManager) RemoveClient(machineID string) {
@@ -28,12 +46,66 @@ func (cm *ClientManager) RemoveClient(machineID string) {
 	delete(cm.clients, machineID)
 }
 
+// Register 用心跳数据登记连接，同一 MachineID 的新连接会替换旧连接；
+// 返回 true 表示本次为新登记
+func (cm *ClientManager) Register(client *Client, heartbeatData *HeartbeatData) bool {
+	cm.mu.Lock()
+
+	if client.IsClosed() {
+		cm.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	client.Hostname = heartbeatData.Hostname
+	client.IP = heartbeatData.IP
+	client.Labels = heartbeatData.Labels
+	client.Facts = heartbeatData.Facts
+	if cm.clients[heartbeatData.MachineID] == client {
+		recovered := client.presence.state == PresenceStale
+		client.presence.lastSeen = now
+		client.presence.state = PresenceOnline
+		cm.mu.Unlock()
+		if recovered {
+			cm.emit(EventRecover, client)
+		}
+		return false
+	}
+	client.MachineID = heartbeatData.MachineID
+	client.presence = presence{state: PresenceOnline, connectedAt: now, lastSeen: now}
+	cm.clients[client.MachineID] = client
+	cm.mu.Unlock()
+
+	cm.emit(EventConnect, client)
+	return true
+}
+
+// RemoveClientConn 仅当 machineID 对应的仍是该连接时才移除，避免旧连接断开时误删重连后的新连接
+func (cm *ClientManager) RemoveClientConn(client *Client) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if client.MachineID != "" && cm.clients[client.MachineID] == client {
+		delete(cm.clients, client.MachineID)
+		return true
+	}
+	return false
+}
+
 func (cm *ClientManager) GetClient(machineID string) *Client {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 	return cm.clients[machineID]
 }
 
+func (cm *ClientManager) ListClients() []*Client {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	clients := make([]*Client, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
 func (cm *ClientManager) HandleHeartbeat(heartbeatData *HeartbeatData) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -45,6 +117,46 @@ func (cm *ClientManager) HandleHeartbeat(heartbeatData *HeartbeatData) {
 	}
 
 	// Update client data from heartbeat
+	client.presence.lastSeen = time.Now()
 	client.Hostname = heartbeatData.Hostname
 	client.IP = heartbeatData.IP
+	client.Labels = heartbeatData.Labels
+	client.Facts = heartbeatData.Facts
+}
+
+// Select 返回匹配选择器表达式的已连接且已接受的 agent
+func (cm *ClientManager) Select(expr string) ([]*Client, error) {
+	selector, err := ParseSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var clients []*Client
+	for _, client := range cm.clients {
+		if client.presence.state == PresenceOffline {
+			continue
+		}
+		if cm.keys != nil && !cm.keys.accepted(client.MachineID) {
+			continue
+		}
+		if selector.Match(client.Attributes()) {
+			clients = append(clients, client)
+		}
+	}
+	return clients, nil
+}
+
+func (cm *ClientManager) SelectMachineIDs(expr string) ([]string, error) {
+	clients, err := cm.Select(expr)
+	if err != nil {
+		return nil, err
+	}
+	machineIDs := make([]string, 0, len(clients))
+	for _, client := range clients {
+		machineIDs = append(machineIDs, client.MachineID)
+	}
+	sort.Strings(machineIDs)
+	return machineIDs, nil
 }
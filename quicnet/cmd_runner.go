@@ -1,19 +1,21 @@
 package quicnet
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
-	"strings"
 	"time"
 )
 
+// scriptWaitDelay 为进程组退出后等待输出管道关闭的最长时间，
+// 脱离进程组的后台进程可能一直持有输出管道
+const scriptWaitDelay = 2 * time.Second
+
 type CmdRunner struct{}
 
 func NewCmdRunner() *CmdRunner {
@@ -69,9 +71,9 @@ func (cr *CmdRunner) RunScript(reqtask *ScriptTask) {
 	args := append(reqtask.InterpreterArgs, tmpfile.Name())
 	args = append(args, reqtask.Params...)
 
-	ctx, cancel := context.WithTimeout(context.Background(), reqtask.Timeout)
+	ctx, cancel := context.WithTimeout(reqtask.context(), reqtask.Timeout)
 	defer cancel()
-	reqtask.Cancel = cancel
+	reqtask.setCancel(cancel)
 
 	cmd := exec.CommandContext(ctx, reqtask.Interpreter, args...)
 
@@ -79,76 +81,126 @@ func (cr *CmdRunner) RunScript(reqtask *ScriptTask) {
 		cmd.Stdin = bytes.NewBufferString(reqtask.Stdin)
 	}
 
+	if err := prepareCommand(cmd, reqtask, tmpfile.Name()); err != nil {
+		r.fail(err, CodeInvalidOptions)
+		return
+	}
+	cg, err := newTaskCgroup(reqtask)
+	if err != nil {
+		r.fail(err, CodeInvalidOptions)
+		return
+	}
+	if cg != nil {
+		cg.attach(cmd)
+	}
+
 	env := make([]string, 0, len(reqtask.Env))
 	for k, v := range reqtask.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
-	cmd.Env = append(os.Environ(), env...)
-
-	stdoutPipeReader, stdoutPipeWriter := io.Pipe()
-	stderrPipeReader, stderrPipeWriter := io.Pipe()
-
-	cmd.Stdout = stdoutPipeWriter
-	cmd.Stderr = stderrPipeWriter
-
-	var stdout, stderr strings.Builder
-	stdoutDone := make(chan struct{})
-	stderrDone := make(chan struct{})
-
-	go func() {
-		defer close(stdoutDone)
-		defer stdoutPipeReader.Close()
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
 
-		reader := bufio.NewReader(stdoutPipeReader)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				break
-			}
-			reqtask.ScriptResult.Stdout += line
+	// 输出边产生边收集，任务设置了 Output 时同时实时发出
+	stdout := newOutputWriter(reqtask, OutputStdout)
+	stderr := newOutputWriter(reqtask, OutputStderr)
+	stdoutPipe, err := newOutputPipe(stdout)
+	if err != nil {
+		if cg != nil {
+			cg.close()
 		}
-	}()
-
-	go func() {
-		defer close(stderrDone)
-		defer stderrPipeReader.Close()
-
-		reader := bufio.NewReader(stderrPipeReader)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				break
-			}
-			reqtask.ScriptResult.Stderr += line
+		r.fail(err, CodeStartFailed)
+		return
+	}
+	stderrPipe, err := newOutputPipe(stderr)
+	if err != nil {
+		if cg != nil {
+			cg.close()
 		}
-	}()
+		stdoutPipe.closeWriter()
+		stdoutPipe.wait(0)
+		r.fail(err, CodeStartFailed)
+		return
+	}
+	cmd.Stdout = stdoutPipe.w
+	cmd.Stderr = stderrPipe.w
+
+	// 脚本在独立的进程组中运行，超时或 Stop 时停止整个进程组
+	setProcessGroup(cmd)
+	group := newProcessGroup(reqtask.GracePeriod)
+	cmd.Cancel = func() error {
+		group.terminate(cmd.Process.Pid)
+		return nil
+	}
+
 	startTime := time.Now()
 	err = cmd.Start()
+	stdoutPipe.closeWriter()
+	stderrPipe.closeWriter()
 	if err != nil {
+		if cg != nil {
+			cg.close()
+		}
+		stdoutPipe.wait(scriptWaitDelay)
+		stderrPipe.wait(scriptWaitDelay)
+		r.Error = err.Error()
+		r.Code = startErrorCode(err)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			r.Code = CodeStopped
+		}
 		return
 	}
+	var startErr error
+	if cg != nil {
+		if startErr = cg.started(cmd.Process.Pid); startErr != nil {
+			cancel()
+		}
+	}
 
 	err = cmd.Wait()
 	endTime := time.Now()
+	// 清理进程组需要时间，超时和取消以脚本退出时为准
+	ctxErr := ctx.Err()
 
-	stdoutPipeWriter.Close()
-	stderrPipeWriter.Close()
-
-	<-stdoutDone
-	<-stderrDone
+	// 脚本退出后清理进程组中残留的后台进程，随后输出管道才会关闭
+	if ctxErr == nil && groupAlive(cmd.Process.Pid) {
+		log.Printf("Script %s left background processes running, terminating them", reqtask.TaskID)
+	}
+	group.terminate(cmd.Process.Pid)
+	group.wait()
+	if cg != nil {
+		r.Usage = cg.close()
+	}
+	stdoutPipe.wait(scriptWaitDelay)
+	stderrPipe.wait(scriptWaitDelay)
 
+	r.Stdout = stdout.String()
+	r.Stderr = stderr.String()
+	if startErr != nil {
+		r.fail(startErr, CodeCgroupUnavailable)
+		return
+	}
 	var exitCode int
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		exitCode = exitErr.ExitCode()
 	}
 
-	if errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(ctxErr, context.DeadlineExceeded) {
 		r.Error = "script execution timeout"
 		r.Code = CodeTimeout
 
 		reqtask.ScriptResult = r
 		return
 	}
+	if errors.Is(ctxErr, context.Canceled) {
+		r.Error = "script execution canceled"
+		r.Code = CodeStopped
+
+		reqtask.ScriptResult = r
+		return
+	}
 
 	// 添加错误信息到 ScriptResult
 	var errorMsg string
@@ -157,9 +209,6 @@ func (cr *CmdRunner) RunScript(reqtask *ScriptTask) {
 		fmt.Println("err:", errorMsg)
 	}
 
-	fmt.Println(stdout.String())
-	fmt.Println(stderr.String())
-
 	r.Code = CodeSuccess
 	r.EndTime = endTime
 	r.StartTime = startTime
@@ -0,0 +1,171 @@
+package quicnet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Codec 负责 Message 的编解码，连接使用的 Codec 在握手时协商
+type Codec interface {
+	Name() string
+	Marshal(msg *Message) ([]byte, error)
+	Unmarshal(data []byte) (*Message, error)
+}
+
+var (
+	// JSONCodec 为默认编码，Data 以 base64 编码
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec 为紧凑的二进制编码，Data 原样写入
+	BinaryCodec Codec = binaryCodec{}
+)
+
+var codecRegistry = struct {
+	sync.RWMutex
+	byName map[string]Codec
+	// order 为握手时声明的编码，靠前的优先
+	order []string
+}{
+	byName: map[string]Codec{"binary": BinaryCodec, "json": JSONCodec},
+	order:  []string{"binary", "json"},
+}
+
+// RegisterCodec 注册自定义编码，同名编码会被替换；新编码的优先级最低
+func RegisterCodec(codec Codec) {
+	codecRegistry.Lock()
+	defer codecRegistry.Unlock()
+	if _, ok := codecRegistry.byName[codec.Name()]; !ok {
+		codecRegistry.order = append(codecRegistry.order, codec.Name())
+	}
+	codecRegistry.byName[codec.Name()] = codec
+}
+
+func codecByName(name string) Codec {
+	codecRegistry.RLock()
+	defer codecRegistry.RUnlock()
+	return codecRegistry.byName[name]
+}
+
+func codecNames() []string {
+	codecRegistry.RLock()
+	defer codecRegistry.RUnlock()
+	return append([]string(nil), codecRegistry.order...)
+}
+
+// selectCodec 按 agent 的偏好顺序选择双方都支持的编码
+func selectCodec(agentCodecs, serverCodecs []string) Codec {
+	for _, name := range agentCodecs {
+		if !containsString(serverCodecs, name) {
+			continue
+		}
+		if codec := codecByName(name); codec != nil {
+			return codec
+		}
+	}
+	return nil
+}
+
+// WithCodecs 设置 agent 愿意使用的编码及其优先顺序，默认为所有已注册的编码
+func WithCodecs(names ...string) ClientOption {
+	return func(c *Client) {
+		c.codecs = names
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// binaryCodec 的格式：版本字节、标志字节、Deadline（varint），
+// 之后依次为 ID、Type、ReplyTo、Code、Error、Data，均为 uvarint 长度前缀加内容
+type binaryCodec struct{}
+
+const binaryCodecVersion = 1
+
+const (
+	binaryFlagWantReply = 1 << iota
+	binaryFlagNeedAck
+)
+
+var errShortMessage = errors.New("binary message truncated")
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Marshal(msg *Message) ([]byte, error) {
+	size := 2 + binary.MaxVarintLen64 + len(msg.ID) + len(msg.Type) + len(msg.ReplyTo) +
+		len(msg.Code) + len(msg.Error) + len(msg.Data) + 6*binary.MaxVarintLen64
+	buf := make([]byte, 0, size)
+
+	var flags byte
+	if msg.WantReply {
+		flags |= binaryFlagWantReply
+	}
+	if msg.NeedAck {
+		flags |= binaryFlagNeedAck
+	}
+	buf = append(buf, binaryCodecVersion, flags)
+	buf = binary.AppendVarint(buf, msg.Deadline)
+	for _, s := range []string{msg.ID, msg.Type, msg.ReplyTo, string(msg.Code), msg.Error} {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(msg.Data)))
+	buf = append(buf, msg.Data...)
+	return buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 2 {
+		return nil, errShortMessage
+	}
+	if data[0] != binaryCodecVersion {
+		return nil, fmt.Errorf("unsupported binary message version %d", data[0])
+	}
+	flags := data[1]
+	data = data[2:]
+
+	deadline, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, errShortMessage
+	}
+	data = data[n:]
+
+	var fields [6][]byte
+	for i := range fields {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, errShortMessage
+		}
+		fields[i] = data[n : n+int(l)]
+		data = data[n+int(l):]
+	}
+
+	msg := &Message{
+		ID:        string(fields[0]),
+		Type:      string(fields[1]),
+		ReplyTo:   string(fields[2]),
+		Code:      ErrorCode(fields[3]),
+		Error:     string(fields[4]),
+		WantReply: flags&binaryFlagWantReply != 0,
+		NeedAck:   flags&binaryFlagNeedAck != 0,
+		Deadline:  deadline,
+	}
+	if len(fields[5]) > 0 {
+		msg.Data = append([]byte(nil), fields[5]...)
+	}
+	return msg, nil
+}
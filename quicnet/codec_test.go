@@ -0,0 +1,80 @@
+package quicnet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func testMessage(size int) *Message {
+	return &Message{
+		ID:        "6f1c2b9e-8d44-4f7a-9b0e-3c2d1a5e7f90",
+		Type:      "script_task",
+		Data:      bytes.Repeat([]byte("output line\n"), size/12),
+		ReplyTo:   "0b7e4c1a-2f3d-4e5f-8a9b-c0d1e2f3a4b5",
+		Code:      ErrCodeDeadlineExceeded,
+		Error:     "context deadline exceeded",
+		WantReply: true,
+		NeedAck:   true,
+		Deadline:  1700000000000,
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, BinaryCodec} {
+		for _, msg := range []*Message{testMessage(1024), {ID: "1", Type: "ack"}} {
+			data, err := codec.Marshal(msg)
+			if err != nil {
+				t.Fatalf("Failed to marshal with %s: %s", codec.Name(), err)
+			}
+			decoded, err := codec.Unmarshal(data)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal with %s: %s", codec.Name(), err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Expected %s to decode %+v, but got %+v", codec.Name(), msg, decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	data, _ := BinaryCodec.Marshal(testMessage(64))
+	for i := 0; i < len(data); i++ {
+		if _, err := BinaryCodec.Unmarshal(data[:i]); err == nil {
+			t.Fatalf("Expected an error for a message truncated at %d, but got none", i)
+		}
+	}
+}
+
+func benchmarkMarshal(b *testing.B, codec Codec, size int) {
+	msg := testMessage(size)
+	data, _ := codec.Marshal(msg)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Marshal(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, codec Codec, size int) {
+	data, _ := codec.Marshal(testMessage(size))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Unmarshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONMarshal1K(b *testing.B)     { benchmarkMarshal(b, JSONCodec, 1<<10) }
+func BenchmarkBinaryMarshal1K(b *testing.B)   { benchmarkMarshal(b, BinaryCodec, 1<<10) }
+func BenchmarkJSONMarshal1M(b *testing.B)     { benchmarkMarshal(b, JSONCodec, 1<<20) }
+func BenchmarkBinaryMarshal1M(b *testing.B)   { benchmarkMarshal(b, BinaryCodec, 1<<20) }
+func BenchmarkJSONUnmarshal1K(b *testing.B)   { benchmarkUnmarshal(b, JSONCodec, 1<<10) }
+func BenchmarkBinaryUnmarshal1K(b *testing.B) { benchmarkUnmarshal(b, BinaryCodec, 1<<10) }
+func BenchmarkJSONUnmarshal1M(b *testing.B)   { benchmarkUnmarshal(b, JSONCodec, 1<<20) }
+func BenchmarkBinaryUnmarshal1M(b *testing.B) { benchmarkUnmarshal(b, BinaryCodec, 1<<20) }
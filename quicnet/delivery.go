@@ -0,0 +1,252 @@
+package quicnet
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	msgTypeAck              = "ack"
+	defaultRedeliveryWindow = 10 * time.Minute
+)
+
+// WithSpool 启用磁盘队列，任务结果等需要可靠送达的消息在服务端确认前会保存在 cfg.Dir 中，
+// 连接断开或 agent 重启后重新发送
+func WithSpool(cfg SpoolConfig) ClientOption {
+	return func(c *Client) {
+		c.spoolCfg = &cfg
+	}
+}
+
+// WithRedeliveryWindow 设置已下发的任务等待断线 agent 重连的时间，超过后任务以 ErrClientDisconnected 结束，默认 10 分钟
+func WithRedeliveryWindow(d time.Duration) ServerOption {
+	return func(s *Server) {
+		if d > 0 {
+			s.redelivery = d
+		}
+	}
+}
+
+// SendReliable 发送需要对端确认的消息，启用磁盘队列时先持久化再发送，未连接时等重连后发送
+func (c *Client) SendReliable(msg *Message) error {
+	msg.NeedAck = true
+	if c.spool == nil {
+		return c.SendMsg(msg)
+	}
+	if err := c.spool.Put(msg); err != nil {
+		log.Printf("Failed to spool message %s: %s", msg.ID, err)
+		return c.SendMsg(msg)
+	}
+	if c.ConnState() != StateConnected {
+		return nil
+	}
+	return c.SendMsg(msg)
+}
+
+// flushSpool 按顺序重新发送磁盘队列中尚未确认的消息
+func (c *Client) flushSpool() {
+	if c.spool == nil {
+		return
+	}
+	pending := c.spool.Pending()
+	if len(pending) > 0 {
+		log.Printf("Flushing %d spooled messages", len(pending))
+	}
+	for _, msg := range pending {
+		if err := c.SendMsg(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) sendAck(msg *Message) {
+	if !msg.NeedAck {
+		return
+	}
+	c.SendMsg(&Message{
+		ID:      uuid.New().String(),
+		Type:    msgTypeAck,
+		ReplyTo: msg.ID,
+		stream:  msg.stream,
+	})
+}
+
+func (c *Client) handleAck(msg *Message) {
+	if c.onAck != nil {
+		c.onAck(msg.ReplyTo)
+	}
+	if c.spool == nil {
+		return
+	}
+	if err := c.spool.Ack(msg.ReplyTo); err != nil {
+		log.Printf("Failed to ack spooled message %s: %s", msg.ReplyTo, err)
+	}
+}
+
+const defaultDedupeWindow = 1024
+
+// dedupeWindow 记录最近见过的键，超过容量时淘汰最早的记录
+type dedupeWindow struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type dedupeItem struct {
+	key   string
+	value interface{}
+}
+
+func newDedupeWindow(size int) *dedupeWindow {
+	return &dedupeWindow{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// add 记录 key，已存在时返回已有的值和 false
+func (w *dedupeWindow) add(key string, value interface{}) (interface{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if e, ok := w.items[key]; ok {
+		return e.Value.(*dedupeItem).value, false
+	}
+	w.items[key] = w.order.PushBack(&dedupeItem{key: key, value: value})
+	for w.order.Len() > w.size {
+		oldest := w.order.Front()
+		w.order.Remove(oldest)
+		delete(w.items, oldest.Value.(*dedupeItem).key)
+	}
+	return value, true
+}
+
+func (w *dedupeWindow) remove(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.items[key]; ok {
+		w.order.Remove(e)
+		delete(w.items, key)
+	}
+}
+
+// update 更新仍在窗口内的 key 的值
+func (w *dedupeWindow) update(key string, value interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.items[key]; ok {
+		e.Value.(*dedupeItem).value = value
+	}
+}
+
+// isDuplicate 记录需要确认的请求，重复收到时重新确认并补发已缓存的回复
+func (c *Client) isDuplicate(msg *Message) bool {
+	if !msg.NeedAck || msg.IsReply() {
+		return false
+	}
+	v, added := c.seen.add(msg.ID, (*Message)(nil))
+	if added {
+		return false
+	}
+	log.Printf("Duplicate message %s (%s)", msg.ID, msg.Type)
+	c.sendAck(msg)
+	if reply, _ := v.(*Message); reply != nil {
+		resend := *reply
+		resend.stream = msg.stream
+		c.SendMsg(&resend)
+	}
+	return true
+}
+
+func (c *Client) rememberReply(reply *Message) {
+	c.seen.update(reply.ReplyTo, reply)
+}
+
+// taskRun 记录同一 TaskID 的一次执行，重复下发的任务等待这次执行的结果
+type taskRun struct {
+	done   chan struct{}
+	result *ScriptResult
+	err    error
+}
+
+func (c *Client) beginTaskRun(taskID string) (*taskRun, bool) {
+	v, added := c.taskRuns.add(taskID, &taskRun{done: make(chan struct{})})
+	return v.(*taskRun), added
+}
+
+// outbox 保存已下发但 agent 尚未确认的消息，agent 重连后按下发顺序重发
+type outbox struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries map[string]*outboxEntry
+}
+
+type outboxEntry struct {
+	seq       uint64
+	machineID string
+	msg       *Message
+}
+
+func newOutbox() *outbox {
+	return &outbox{entries: make(map[string]*outboxEntry)}
+}
+
+func (o *outbox) add(machineID string, msg *Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.seq++
+	o.entries[msg.ID] = &outboxEntry{seq: o.seq, machineID: machineID, msg: msg}
+}
+
+func (o *outbox) remove(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.entries, id)
+}
+
+// ack 移除 machineID 确认收到的消息，其他 agent 的确认被忽略
+func (o *outbox) ack(machineID, id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e, ok := o.entries[id]; ok && e.machineID == machineID {
+		delete(o.entries, id)
+	}
+}
+
+func (o *outbox) pending(machineID string) []*Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var entries []*outboxEntry
+	for _, e := range o.entries {
+		if e.machineID == machineID {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	msgs := make([]*Message, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.msg
+	}
+	return msgs
+}
+
+// redeliver 向重新连接的 agent 重发未确认的消息
+func (s *Server) redeliver(client *Client) {
+	msgs := s.outbox.pending(client.MachineID)
+	if len(msgs) == 0 {
+		return
+	}
+	log.Printf("Redelivering %d unacknowledged messages to %s", len(msgs), client.MachineID)
+	for _, msg := range msgs {
+		if err := client.SendMsg(msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	w := newDedupeWindow(2)
+	if _, added := w.add("a", 1); !added {
+		t.Errorf("Expected a to be added")
+	}
+	if v, added := w.add("a", 2); added || v != 1 {
+		t.Errorf("Expected duplicate a to return 1, but got %v (added: %v)", v, added)
+	}
+	w.update("a", 3)
+	w.add("b", 1)
+	w.add("c", 1)
+	// 超过容量时淘汰最早的 a
+	if _, added := w.add("a", 4); !added {
+		t.Errorf("Expected the oldest key to be evicted")
+	}
+	w.remove("c")
+	if _, added := w.add("c", 1); !added {
+		t.Errorf("Expected a removed key to be added again")
+	}
+}
+
+func newDeliveryClient() *Client {
+	return &Client{
+		seen: newDedupeWindow(defaultDedupeWindow),
+		msg:  make(chan *Message, 10),
+		done: make(chan struct{}),
+	}
+}
+
+func expectSent(t *testing.T, c *Client, msgType, replyTo string) {
+	t.Helper()
+	select {
+	case msg := <-c.msg:
+		if msg.Type != msgType || msg.ReplyTo != replyTo {
+			t.Errorf("Expected %s replying to %s, but got %s replying to %s", msgType, replyTo, msg.Type, msg.ReplyTo)
+		}
+	default:
+		t.Errorf("Expected %s replying to %s to be sent", msgType, replyTo)
+	}
+}
+
+func TestIsDuplicate(t *testing.T) {
+	c := newDeliveryClient()
+	req := &Message{ID: "req", Type: "script_task", NeedAck: true}
+
+	if c.isDuplicate(req) {
+		t.Fatalf("Expected the first delivery not to be a duplicate")
+	}
+	if !c.isDuplicate(req) {
+		t.Fatalf("Expected the second delivery to be a duplicate")
+	}
+	// 重复的请求重新确认
+	expectSent(t, c, msgTypeAck, "req")
+
+	c.rememberReply(&Message{ID: "reply", Type: "script_task", ReplyTo: "req"})
+	if !c.isDuplicate(req) {
+		t.Fatalf("Expected the third delivery to be a duplicate")
+	}
+	expectSent(t, c, msgTypeAck, "req")
+	expectSent(t, c, "script_task", "req")
+
+	if c.isDuplicate(&Message{ID: "req", Type: "script_task"}) {
+		t.Errorf("Expected messages without NeedAck never to be duplicates")
+	}
+}
+
+func TestOutboxAck(t *testing.T) {
+	o := newOutbox()
+	o.add("m1", &Message{ID: "a"})
+	o.add("m1", &Message{ID: "b"})
+	o.add("m2", &Message{ID: "c"})
+
+	// 其他 agent 不能确认不属于它的消息
+	o.ack("m2", "a")
+	o.ack("m1", "b")
+	pending := messageIDs(o.pending("m1"))
+	if len(pending) != 1 || pending[0] != "a" {
+		t.Errorf("Expected a to be pending for m1, but got %v", pending)
+	}
+}
+
+func TestResolveTaskFromOtherAgent(t *testing.T) {
+	s := &Server{tasks: newPendingTasks(), outbox: newOutbox()}
+	f := newTaskFuture("m1", "msg", "task")
+	s.tasks.add(f)
+
+	data, _ := json.Marshal(&ScriptResult{Code: CodeSuccess})
+	reply := &Message{ID: "reply", Type: "script_task", ReplyTo: "msg", Data: data}
+	if s.resolveTask(reply, &Client{MachineID: "m2"}) {
+		t.Errorf("Expected a reply from another agent not to resolve the task")
+	}
+	if !s.resolveTask(reply, &Client{MachineID: "m1"}) {
+		t.Fatalf("Expected the reply from m1 to resolve the task")
+	}
+	if result, err := f.Result(); err != nil || result.Code != CodeSuccess {
+		t.Errorf("Expected a successful result, but got %+v, %v", result, err)
+	}
+}
+
+func TestTaskRunLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openTaskRunLog(dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to open task run log: %s", err)
+	}
+	for _, id := range []string{"t1", "t2", "t3"} {
+		l.start(id)
+	}
+	l.finish("t3", &ScriptResult{Code: CodeSuccess, Stdout: "done\n"}, nil)
+	l.start("t4")
+	l.Close()
+
+	l, err = openTaskRunLog(dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen task run log: %s", err)
+	}
+	defer l.Close()
+	w := newDedupeWindow(2)
+	l.restore(w)
+
+	v, _ := w.add("t3", nil)
+	if run, _ := v.(*taskRun); run == nil || run.result == nil || run.result.Stdout != "done\n" {
+		t.Errorf("Expected t3 to keep its result, but got %+v", v)
+	}
+	// 重启前未执行完的任务不会再次执行
+	v, _ = w.add("t4", nil)
+	if run, _ := v.(*taskRun); run == nil || run.result == nil || run.result.Code != CodeInterrupted {
+		t.Errorf("Expected t4 to be interrupted, but got %+v", v)
+	}
+	// 只保留最近的两个任务
+	if _, added := w.add("t2", nil); !added {
+		t.Errorf("Expected t2 to be dropped from the window")
+	}
+}
+
+func dispatchMarkerTask(t *testing.T, s *Server, machineID, taskID, marker string) {
+	t.Helper()
+	req := &ScriptTaskRequest{TaskID: taskID, Content: "echo run >> " + marker}
+	f, err := s.Dispatch(context.Background(), machineID, req)
+	if err != nil {
+		t.Fatalf("Failed to dispatch %s: %s", taskID, err)
+	}
+	if result, err := f.Result(); err != nil || result.Code != CodeSuccess {
+		t.Fatalf("Expected %s to succeed, but got %+v, %v", taskID, result, err)
+	}
+}
+
+func expectRuns(t *testing.T, marker string, n int) {
+	t.Helper()
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("Failed to read marker: %s", err)
+	}
+	if runs := strings.Count(string(data), "run\n"); runs != n {
+		t.Errorf("Expected the script to run %d times, but got %d", n, runs)
+	}
+}
+
+func TestScriptTaskRunsOnce(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	dispatchMarkerTask(t, s, c.MachineID, "once", marker)
+	dispatchMarkerTask(t, s, c.MachineID, "once", marker)
+	expectRuns(t, marker, 1)
+	if pending := s.outbox.pending(c.MachineID); len(pending) != 0 {
+		t.Errorf("Expected acknowledged tasks to leave the outbox, but got %v", messageIDs(pending))
+	}
+}
+
+func TestScriptTaskRunsOnceAcrossRestart(t *testing.T) {
+	s := newTestServer(t)
+	spoolDir := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	c := newTestClient(t, s, withMachineID("restarted-agent"), WithSpool(SpoolConfig{Dir: spoolDir}))
+	dispatchMarkerTask(t, s, c.MachineID, "restart", marker)
+	c.Close()
+
+	// 重启后的 agent 使用同一目录，重复下发的任务直接返回记录的结果
+	c = newTestClient(t, s, withMachineID("restarted-agent"), WithSpool(SpoolConfig{Dir: spoolDir}))
+	eventually(t, 3*time.Second, func() bool {
+		client := s.ClientManager().GetClient(c.MachineID)
+		return client != nil && !client.IsClosed()
+	})
+	dispatchMarkerTask(t, s, c.MachineID, "restart", marker)
+	expectRuns(t, marker, 1)
+}
+
+func TestRedeliverAfterReconnect(t *testing.T) {
+	s := newTestServer(t)
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	// 模拟 agent 断线前已下发但未确认的任务
+	data, _ := json.Marshal(&ScriptTaskRequest{TaskID: "redeliver", Content: "echo run >> " + marker})
+	s.outbox.add("redeliver-agent", &Message{ID: "redeliver-msg", Type: "script_task", Data: data, WantReply: true, NeedAck: true})
+
+	newTestClient(t, s, withMachineID("redeliver-agent"))
+	eventually(t, 3*time.Second, func() bool {
+		_, err := os.Stat(marker)
+		return err == nil && len(s.outbox.pending("redeliver-agent")) == 0
+	})
+	expectRuns(t, marker, 1)
+}
+
+func expectDisconnected(t *testing.T, f *TaskFuture) {
+	t.Helper()
+	select {
+	case <-f.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected task %s to finish after the agent left, but it is still pending", f.TaskID)
+	}
+	if _, err := f.Result(); err != ErrClientDisconnected {
+		t.Errorf("Expected %v, but got %v", ErrClientDisconnected, err)
+	}
+}
+
+func TestDispatchAgentDoesNotReconnect(t *testing.T) {
+	s := newTestServer(t, WithRedeliveryWindow(200*time.Millisecond))
+	c := newTestClient(t, s, withMachineID("gone-agent"))
+
+	f, err := s.Dispatch(context.Background(), c.MachineID, &ScriptTaskRequest{TaskID: "gone", Content: "sleep 5"})
+	if err != nil {
+		t.Fatalf("Failed to dispatch task: %s", err)
+	}
+	c.Close()
+	expectDisconnected(t, f)
+	eventually(t, time.Second, func() bool { return len(s.outbox.pending(c.MachineID)) == 0 })
+}
+
+func TestDispatchAgentEvicted(t *testing.T) {
+	s := newTestServer(t, WithRedeliveryWindow(time.Hour))
+	c := newTestClient(t, s, withMachineID("evicted-agent"))
+
+	f, err := s.Dispatch(context.Background(), c.MachineID, &ScriptTaskRequest{TaskID: "evicted", Content: "sleep 5"})
+	if err != nil {
+		t.Fatalf("Failed to dispatch task: %s", err)
+	}
+	c.Close()
+	eventually(t, 3*time.Second, func() bool {
+		info, ok := s.ClientManager().Presence(c.MachineID)
+		return ok && info.State == PresenceOffline
+	})
+	s.ClientManager().sweep(time.Now().Add(25 * time.Hour))
+	expectDisconnected(t, f)
+}
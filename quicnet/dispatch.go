@@ -0,0 +1,246 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrClientNotFound     = errors.New("client not found")
+	ErrClientDisconnected = errors.New("client disconnected")
+)
+
+// TaskFuture 对应一次下发的脚本任务，agent 回复 ReplyTo 为 MsgID 的结果后完成，
+// 结果可以来自 agent 重连后的新连接
+type TaskFuture struct {
+	MachineID string
+	MsgID     string
+	TaskID    string
+
+	done   chan struct{}
+	once   sync.Once
+	result *ScriptResult
+	err    error
+}
+
+func newTaskFuture(machineID, msgID, taskID string) *TaskFuture {
+	return &TaskFuture{
+		MachineID: machineID,
+		MsgID:     msgID,
+		TaskID:    taskID,
+		done:      make(chan struct{}),
+	}
+}
+
+func (f *TaskFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result 阻塞直到任务完成、ctx 结束，或 agent 断开后未在重投窗口内重连、被移除
+func (f *TaskFuture) Result() (*ScriptResult, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+func (f *TaskFuture) resolve(result *ScriptResult, err error) {
+	f.once.Do(func() {
+		f.result = result
+		f.err = err
+		close(f.done)
+	})
+}
+
+// connectedClient 返回在线的 agent 连接，已断开但尚未移除的 agent 返回 ErrClientDisconnected
+func (s *Server) connectedClient(machineID string) (*Client, error) {
+	client := s.cm.GetClient(machineID)
+	if client == nil {
+		return nil, ErrClientNotFound
+	}
+	if client.IsClosed() {
+		return nil, ErrClientDisconnected
+	}
+	if !s.cm.Accepted(machineID) {
+		return nil, ErrAgentNotAccepted
+	}
+	return client, nil
+}
+
+// Dispatch 向指定 agent 下发脚本任务，返回的 TaskFuture 在收到结果或 ctx 结束时完成。
+// 任务在 agent 确认收到前保留在 outbox 中，agent 断线重连后会重新下发；
+// agent 断开后超过重投窗口仍未重连或被 sweeper 移除时以 ErrClientDisconnected 完成
+func (s *Server) Dispatch(ctx context.Context, machineID string, req *ScriptTaskRequest) (*TaskFuture, error) {
+	client, err := s.connectedClient(machineID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.TaskID == "" {
+		req.TaskID = uuid.New().String()
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		ID:        uuid.New().String(),
+		Type:      "script_task",
+		Data:      data,
+		WantReply: true,
+		NeedAck:   true,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Deadline = deadline.UnixMilli()
+	}
+	if err := s.authorizeOperator(ctx, msg, client); err != nil {
+		return nil, err
+	}
+
+	// 每个任务使用独占的流，避免大结果阻塞心跳和其他任务；打开失败时走控制流
+	ms, err := client.openStream(ctx, msg.Type, req.TaskID)
+	if err != nil {
+		log.Printf("Failed to open stream for task %s on %s: %s", req.TaskID, machineID, err)
+	} else {
+		msg.stream = ms
+	}
+
+	if req.StreamOutput {
+		s.output.start(req.TaskID, machineID)
+	}
+	f := newTaskFuture(machineID, msg.ID, req.TaskID)
+	s.tasks.add(f)
+	s.outbox.add(machineID, msg)
+	if err := client.SendMsg(msg); err != nil {
+		log.Printf("Failed to send task %s to %s, will resend after reconnect: %s", req.TaskID, machineID, err)
+	}
+
+	go func() {
+		s.awaitTask(ctx, f, client)
+		s.tasks.remove(msg.ID)
+		s.outbox.remove(msg.ID)
+		s.output.finish(req.TaskID, machineID)
+		if ms != nil {
+			ms.close()
+		}
+	}()
+	return f, nil
+}
+
+// awaitTask 等待任务完成，agent 断开后在 s.redelivery 内没有新的连接时以 ErrClientDisconnected 结束
+func (s *Server) awaitTask(ctx context.Context, f *TaskFuture, client *Client) {
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ctx.Done():
+			f.resolve(nil, ctx.Err())
+			return
+		case <-client.Done():
+		}
+
+		timer := time.NewTimer(s.redelivery)
+		select {
+		case <-f.done:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			f.resolve(nil, ctx.Err())
+			return
+		case <-timer.C:
+		}
+		next := s.cm.GetClient(f.MachineID)
+		if next == nil || next == client || next.IsClosed() {
+			f.resolve(nil, ErrClientDisconnected)
+			return
+		}
+		client = next
+	}
+}
+
+// resolveTask 用 agent 回复的结果完成对应的 TaskFuture，返回 false 表示没有等待中的任务。
+// 只接受任务所下发的 agent 的回复
+func (s *Server) resolveTask(reply *Message, client *Client) bool {
+	f := s.tasks.removeFor(reply.ReplyTo, client.MachineID)
+	if f == nil {
+		return false
+	}
+	s.outbox.remove(reply.ReplyTo)
+	if err := reply.Err(); err != nil {
+		f.resolve(nil, err)
+		return true
+	}
+	var result ScriptResult
+	if err := json.Unmarshal(reply.Data, &result); err != nil {
+		f.resolve(nil, err)
+		return true
+	}
+	f.resolve(&result, nil)
+	return true
+}
+
+type pendingTasks struct {
+	mu    sync.Mutex
+	tasks map[string]*TaskFuture
+}
+
+func newPendingTasks() *pendingTasks {
+	return &pendingTasks{tasks: make(map[string]*TaskFuture)}
+}
+
+func (p *pendingTasks) add(f *TaskFuture) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tasks[f.MsgID] = f
+}
+
+// removeFor 仅当任务下发给 machineID 时移除并返回该任务
+func (p *pendingTasks) removeFor(msgID, machineID string) *TaskFuture {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.tasks[msgID]
+	if f == nil || f.MachineID != machineID {
+		return nil
+	}
+	delete(p.tasks, msgID)
+	return f
+}
+
+// pendingFor 判断 msgID 是否为下发给 machineID 且仍在等待结果的任务
+func (p *pendingTasks) pendingFor(msgID, machineID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.tasks[msgID]
+	return f != nil && f.MachineID == machineID
+}
+
+// failFor 以 err 结束所有下发给 machineID 的任务
+func (p *pendingTasks) failFor(machineID string, err error) {
+	p.mu.Lock()
+	var failed []*TaskFuture
+	for msgID, f := range p.tasks {
+		if f.MachineID == machineID {
+			delete(p.tasks, msgID)
+			failed = append(failed, f)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, f := range failed {
+		f.resolve(nil, err)
+	}
+}
+
+func (p *pendingTasks) remove(msgID string) *TaskFuture {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.tasks[msgID]
+	delete(p.tasks, msgID)
+	return f
+}
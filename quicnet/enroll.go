@@ -0,0 +1,324 @@
+package quicnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/denisbrodbeck/machineid"
+	"github.com/google/uuid"
+	quic "github.com/quic-go/quic-go"
+)
+
+const msgTypeEnroll = "enroll"
+
+// agent 入网后保存在本地目录中的文件
+const (
+	ClientCertFile = "client.crt"
+	ClientKeyFile  = "client.key"
+	ClientCAFile   = "ca.crt"
+)
+
+type EnrollRequest struct {
+	Token     string `json:"token"`
+	MachineID string `json:"machine_id"`
+	Hostname  string `json:"hostname"`
+	CSR       string `json:"csr"`
+}
+
+// EnrollResponse 为入网和证书续期的回复
+type EnrollResponse struct {
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca_certificate"`
+}
+
+// WithEnrollment 启用 agent 入网：没有客户端证书的连接只能发送入网请求，
+// 持有有效令牌的 agent 可以获得由 ca 签发的客户端证书
+func WithEnrollment(ca *CA, tokens *TokenStore) ServerOption {
+	return func(s *Server) {
+		s.ca = ca
+		s.tokens = tokens
+		s.requireID = true
+	}
+}
+
+// WithCA 使用 ca 为已入网的 agent 续签证书
+func WithCA(ca *CA) ServerOption {
+	return func(s *Server) {
+		s.ca = ca
+	}
+}
+
+// HandleEnroll 校验入网令牌并为 agent 的 CSR 签发证书
+func (s *Server) HandleEnroll(msg *Message, client *Client) error {
+	if msg.IsReply() {
+		return nil
+	}
+	if s.ca == nil || s.tokens == nil {
+		return NewRemoteError(ErrCodeBadRequest, "enrollment is not enabled")
+	}
+	var req EnrollRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return NewRemoteError(ErrCodeBadRequest, "invalid enroll request: %s", err)
+	}
+	if req.MachineID == "" {
+		return NewRemoteError(ErrCodeBadRequest, "enroll request without machine id")
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return NewRemoteError(ErrCodeBadRequest, "invalid csr")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return NewRemoteError(ErrCodeBadRequest, "invalid csr: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return NewRemoteError(ErrCodeBadRequest, "invalid csr signature: %s", err)
+	}
+
+	token, err := s.tokens.check(req.Token, req.MachineID)
+	if err != nil {
+		log.Printf("Rejecting enrollment of %s from %s: %s", req.MachineID, client.IP, err)
+		return NewRemoteError(ErrCodeUnauthenticated, "%s", err)
+	}
+	// 已存在或已吊销的 MachineID 只能使用绑定到该 MachineID 的令牌重新入网，
+	// 否则持有令牌即可为其他 agent 签发证书
+	if token.MachineID == "" {
+		if reason := s.enrollConflict(req.MachineID); reason != "" {
+			log.Printf("Rejecting enrollment of %s from %s: %s", req.MachineID, client.IP, reason)
+			return NewRemoteError(ErrCodePermissionDenied, "machine id %s %s", req.MachineID, reason)
+		}
+	}
+	// 签发成功后才记录令牌的使用，签发失败不会浪费一次性令牌
+	cert, err := s.ca.SignClientCSR(csr, req.MachineID)
+	if err != nil {
+		return err
+	}
+	if token, err = s.tokens.consume(req.Token, req.MachineID); err != nil {
+		log.Printf("Rejecting enrollment of %s from %s: %s", req.MachineID, client.IP, err)
+		return NewRemoteError(ErrCodeUnauthenticated, "%s", err)
+	}
+	if ks := s.cm.keyStore(); ks != nil {
+		ks.noteEnrollment(req.MachineID, publicKeyFingerprint(csr.RawSubjectPublicKeyInfo), req.Hostname, token.ID, token.MachineID != "")
+	}
+	log.Printf("Enrolled %s (%s) from %s with token %s", req.MachineID, req.Hostname, client.IP, token.ID)
+	return client.Reply(msg, EnrollResponse{
+		Certificate:   string(cert),
+		CACertificate: string(s.ca.CertificatePEM()),
+	})
+}
+
+// enrollConflict 返回 machineID 不能用普通令牌入网的原因，可以入网时返回空字符串
+func (s *Server) enrollConflict(machineID string) string {
+	switch {
+	case s.crl != nil && s.crl.IsRevoked(nil, machineID):
+		return "is revoked"
+	case s.tokens.enrolled(machineID):
+		return "is already enrolled"
+	case s.cm.GetClient(machineID) != nil:
+		return "is already connected"
+	}
+	if ks := s.cm.keyStore(); ks != nil {
+		if _, ok := ks.Get(machineID); ok {
+			return "is already known"
+		}
+	}
+	return ""
+}
+
+type EnrollConfig struct {
+	ServerAddr string
+	Token      string
+	// Dir 为保存证书和私钥的目录
+	Dir string
+	// CAFingerprint 为服务端 CA 证书的 SHA-256（CA.Fingerprint），用于在拿到 CA 证书前校验服务端。
+	// 为空时使用 TLSConfig 校验服务端
+	CAFingerprint string
+	TLSConfig     *tls.Config
+	QuicConfig    *quic.Config
+}
+
+// Enroll 使用入网令牌向服务端申请客户端证书，并将证书、私钥和 CA 证书保存到 cfg.Dir，
+// 之后可用 LoadEnrolledTLSConfig 创建 NewClient 使用的 TLS 配置
+func Enroll(ctx context.Context, cfg EnrollConfig) error {
+	machineID, err := machineid.ID()
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: machineID},
+	}, key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(EnrollRequest{
+		Token:     cfg.Token,
+		MachineID: machineID,
+		Hostname:  hostname,
+		CSR:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+	})
+	if err != nil {
+		return err
+	}
+
+	reply, err := enrollCall(ctx, cfg, &Message{
+		ID:        uuid.New().String(),
+		Type:      msgTypeEnroll,
+		Data:      data,
+		WantReply: true,
+	})
+	if err != nil {
+		return err
+	}
+	var resp EnrollResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return err
+	}
+	if cfg.CAFingerprint != "" {
+		block, _ := pem.Decode([]byte(resp.CACertificate))
+		if block == nil {
+			return errors.New("invalid ca certificate in enroll response")
+		}
+		caCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		if certFingerprint(caCert) != cfg.CAFingerprint {
+			return errors.New("ca certificate does not match fingerprint")
+		}
+	}
+
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(cfg.Dir, ClientKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(cfg.Dir, ClientCertFile), []byte(resp.Certificate), 0644); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(cfg.Dir, ClientCAFile), []byte(resp.CACertificate), 0644)
+}
+
+// enrollCall 建立一个没有客户端证书的临时连接，发送入网请求并等待回复
+func enrollCall(ctx context.Context, cfg EnrollConfig, msg *Message) (*Message, error) {
+	tlsCfg, err := enrollTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	session, err := quic.DialAddrContext(ctx, cfg.ServerAddr, tlsCfg, cfg.QuicConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer session.CloseWithError(CloseNormal, "")
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	caps, err := clientHello(stream, localHello(NewMessageHandler(0), codecNames(), defaultMaxFrameSize, false))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+		msg.Deadline = deadline.UnixMilli()
+	}
+	data, err := caps.codec.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writePacket(stream, data, frameOptions{maxSize: caps.MaxFrameSize}); err != nil {
+		return nil, err
+	}
+	for {
+		data, err := readPacket(stream, frameOptions{maxSize: defaultMaxFrameSize})
+		if err != nil {
+			return nil, err
+		}
+		reply, err := caps.codec.Unmarshal(data)
+		if err != nil {
+			return nil, err
+		}
+		// 跳过服务端对请求的确认
+		if reply.ReplyTo != msg.ID || reply.Type == msgTypeAck {
+			continue
+		}
+		return reply, reply.Err()
+	}
+}
+
+func enrollTLSConfig(cfg EnrollConfig) (*tls.Config, error) {
+	var tlsCfg *tls.Config
+	if cfg.TLSConfig != nil {
+		tlsCfg = cfg.TLSConfig.Clone()
+	} else {
+		tlsCfg = &tls.Config{NextProtos: []string{NextProto}, MinVersion: tls.VersionTLS13}
+	}
+	if cfg.CAFingerprint == "" {
+		if cfg.TLSConfig == nil {
+			return nil, errors.New("enroll requires a ca fingerprint or a tls config")
+		}
+		return tlsCfg, nil
+	}
+	// 尚无 CA 证书，改为检查服务端证书链中是否包含指定指纹的 CA
+	tlsCfg.InsecureSkipVerify = true
+	tlsCfg.VerifyConnection = func(state tls.ConnectionState) error {
+		certs := state.PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		for _, c := range certs[1:] {
+			if certFingerprint(c) != cfg.CAFingerprint {
+				continue
+			}
+			pool := x509.NewCertPool()
+			pool.AddCert(c)
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: pool})
+			return err
+		}
+		return fmt.Errorf("server certificate is not signed by ca %s", cfg.CAFingerprint)
+	}
+	return tlsCfg, nil
+}
+
+// LoadEnrolledTLSConfig 使用 Enroll 保存在 dir 中的证书创建客户端 TLS 配置
+func LoadEnrolledTLSConfig(dir string) (*tls.Config, error) {
+	return NewClientTLSConfig(
+		filepath.Join(dir, ClientCertFile),
+		filepath.Join(dir, ClientKeyFile),
+		filepath.Join(dir, ClientCAFile),
+	)
+}
+
+// IsEnrolled 判断 dir 中是否已有入网得到的证书
+func IsEnrolled(dir string) bool {
+	for _, name := range []string{ClientCertFile, ClientKeyFile, ClientCAFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
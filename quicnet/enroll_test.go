@@ -0,0 +1,109 @@
+package quicnet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newEnrollServer(t *testing.T) (*Server, *TokenStore) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca"))
+	if err != nil {
+		t.Fatalf("Failed to create CA: %s", err)
+	}
+	ts, err := OpenTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatalf("Failed to open token store: %s", err)
+	}
+	crl, err := OpenRevocationList(filepath.Join(dir, "crl.json"))
+	if err != nil {
+		t.Fatalf("Failed to open revocation list: %s", err)
+	}
+	return &Server{cm: NewClientManager(), ca: ca, tokens: ts, crl: crl}, ts
+}
+
+// enroll 以 machineID 的身份发送入网请求，返回 HandleEnroll 的错误
+func enroll(t *testing.T, s *Server, token, machineID string) error {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: machineID},
+	}, key)
+	if err != nil {
+		t.Fatalf("Failed to create csr: %s", err)
+	}
+	data, _ := json.Marshal(EnrollRequest{
+		Token:     token,
+		MachineID: machineID,
+		CSR:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	})
+	return s.HandleEnroll(&Message{ID: "enroll", Type: msgTypeEnroll, Data: data, WantReply: true}, newDeliveryClient())
+}
+
+func expectRemoteCode(t *testing.T, err error, code ErrorCode) {
+	t.Helper()
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != code {
+		t.Errorf("Expected error with code %s, but got %v", code, err)
+	}
+}
+
+func tokenUses(ts *TokenStore, id string) int {
+	for _, tok := range ts.List() {
+		if tok.ID == id {
+			return tok.Uses
+		}
+	}
+	return -1
+}
+
+func TestEnrollExistingMachine(t *testing.T) {
+	s, ts := newEnrollServer(t)
+	first, _, _ := ts.Create(TokenOptions{})
+	second, tok, _ := ts.Create(TokenOptions{})
+
+	if err := enroll(t, s, first, "m1"); err != nil {
+		t.Fatalf("Expected m1 to enroll, but got %s", err)
+	}
+	// 普通令牌不能为已入网的 MachineID 签发证书，被拒绝时不消耗令牌
+	expectRemoteCode(t, enroll(t, s, second, "m1"), ErrCodePermissionDenied)
+	if uses := tokenUses(ts, tok.ID); uses != 0 {
+		t.Errorf("Expected a refused enrollment not to use the token, but got %d uses", uses)
+	}
+
+	// 绑定到 m1 的令牌可以重新入网，但不能用于其他 MachineID
+	bound, _, _ := ts.Create(TokenOptions{MachineID: "m1", MaxUses: 2})
+	expectRemoteCode(t, enroll(t, s, bound, "m2"), ErrCodeUnauthenticated)
+	if err := enroll(t, s, bound, "m1"); err != nil {
+		t.Errorf("Expected m1 to re-enroll with a bound token, but got %s", err)
+	}
+
+	if err := enroll(t, s, second, "m2"); err != nil {
+		t.Errorf("Expected m2 to enroll, but got %s", err)
+	}
+}
+
+func TestEnrollRevokedMachine(t *testing.T) {
+	s, ts := newEnrollServer(t)
+	if err := s.crl.RevokeMachine("m1", "compromised"); err != nil {
+		t.Fatalf("Failed to revoke m1: %s", err)
+	}
+	token, _, _ := ts.Create(TokenOptions{})
+	expectRemoteCode(t, enroll(t, s, token, "m1"), ErrCodePermissionDenied)
+
+	ks, _ := OpenKeyStore("")
+	s.cm.keys = ks
+	ks.noteEnrollment("m2", "fingerprint", "", "", false)
+	expectRemoteCode(t, enroll(t, s, token, "m2"), ErrCodePermissionDenied)
+}
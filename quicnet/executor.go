@@ -0,0 +1,188 @@
+package quicnet
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultMaxConcurrentTasks = 4
+	defaultTaskQueueSize      = 100
+)
+
+var ErrQueueFull = errors.New("task queue is full")
+
+// ExecutorConfig 为 agent 执行脚本任务的并发限制。
+// 超过并发数的任务按 Priority 从高到低、同优先级按到达顺序排队
+type ExecutorConfig struct {
+	// MaxConcurrent 为同时运行的任务数，默认为 4
+	MaxConcurrent int
+	// QueueSize 为排队等待的任务数上限，队列满时拒绝新任务，默认为 100
+	QueueSize int
+	// TypeLimits 限制同一 Type 的任务同时运行的数量，例如 {"package": 1}
+	TypeLimits map[string]int
+	// CgroupSlice 为 cgroup v2 下容纳各任务 cgroup 的 slice，相对于 /sys/fs/cgroup，默认为 lops.slice
+	CgroupSlice string
+}
+
+func (cfg ExecutorConfig) withDefaults() ExecutorConfig {
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = defaultMaxConcurrentTasks
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultTaskQueueSize
+	}
+	return cfg
+}
+
+// WithExecutor 设置 agent 执行脚本任务的并发数、队列长度和按类型的并发限制
+func WithExecutor(cfg ExecutorConfig) ClientOption {
+	return func(c *Client) {
+		c.executor = newExecutor(cfg)
+	}
+}
+
+// ExecutorStats 为执行器当前的运行和排队情况
+type ExecutorStats struct {
+	Running       int
+	Queued        int
+	RunningByType map[string]int
+}
+
+type executor struct {
+	cfg ExecutorConfig
+
+	mu      sync.Mutex
+	seq     uint64
+	running map[string]int
+	total   int
+	queue   []*queuedTask
+}
+
+type queuedTask struct {
+	taskID   string
+	taskType string
+	priority int
+	seq      uint64
+	started  bool
+	start    chan struct{}
+}
+
+func newExecutor(cfg ExecutorConfig) *executor {
+	return &executor{
+		cfg:     cfg.withDefaults(),
+		running: make(map[string]int),
+	}
+}
+
+// acquire 等待任务可以运行，返回的函数在任务结束后释放名额。
+// 队列已满时返回 ErrQueueFull，ctx 结束时放弃排队
+func (e *executor) acquire(ctx context.Context, taskID, taskType string, priority int) (func(), error) {
+	e.mu.Lock()
+	e.seq++
+	qt := &queuedTask{
+		taskID:   taskID,
+		taskType: taskType,
+		priority: priority,
+		seq:      e.seq,
+		start:    make(chan struct{}),
+	}
+	e.queue = append(e.queue, qt)
+	sort.SliceStable(e.queue, func(i, j int) bool {
+		if e.queue[i].priority != e.queue[j].priority {
+			return e.queue[i].priority > e.queue[j].priority
+		}
+		return e.queue[i].seq < e.queue[j].seq
+	})
+	e.schedule()
+	if !qt.started && len(e.queue) > e.cfg.QueueSize {
+		e.remove(qt)
+		e.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	e.mu.Unlock()
+
+	release := func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.total--
+		e.running[qt.taskType]--
+		e.schedule()
+	}
+	select {
+	case <-qt.start:
+		return release, nil
+	case <-ctx.Done():
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		// 放弃排队的同时可能已被调度
+		if qt.started {
+			e.total--
+			e.running[qt.taskType]--
+			e.schedule()
+		} else {
+			e.remove(qt)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// schedule 按队列顺序启动所有未超过限制的任务，受类型限制的任务不阻塞其后的任务
+func (e *executor) schedule() {
+	for i := 0; i < len(e.queue) && e.total < e.cfg.MaxConcurrent; {
+		qt := e.queue[i]
+		if limit, ok := e.cfg.TypeLimits[qt.taskType]; ok && e.running[qt.taskType] >= limit {
+			i++
+			continue
+		}
+		e.queue = append(e.queue[:i], e.queue[i+1:]...)
+		e.total++
+		e.running[qt.taskType]++
+		qt.started = true
+		close(qt.start)
+	}
+}
+
+func (e *executor) remove(qt *queuedTask) {
+	for i, q := range e.queue {
+		if q == qt {
+			e.queue = append(e.queue[:i], e.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// position 返回任务在队列中的位置，从 1 开始，未在排队时返回 0
+func (e *executor) position(taskID string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, qt := range e.queue {
+		if qt.taskID == taskID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (e *executor) stats() ExecutorStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := ExecutorStats{
+		Running:       e.total,
+		Queued:        len(e.queue),
+		RunningByType: make(map[string]int),
+	}
+	for t, n := range e.running {
+		if n > 0 {
+			stats.RunningByType[t] = n
+		}
+	}
+	return stats
+}
+
+// ExecutorStats 返回 agent 上正在运行和排队的任务数
+func (c *Client) ExecutorStats() ExecutorStats {
+	return c.executor.stats()
+}
@@ -0,0 +1,82 @@
+package quicnet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExecutor(t *testing.T) {
+	e := newExecutor(ExecutorConfig{MaxConcurrent: 2, QueueSize: 3, TypeLimits: map[string]int{"package": 1}})
+	ctx := context.Background()
+
+	started := make(chan string, 3)
+	acquire := func(id, typ string, priority int) {
+		release, err := e.acquire(ctx, id, typ, priority)
+		if err != nil {
+			t.Errorf("Failed to acquire %s: %s", id, err)
+			return
+		}
+		started <- id
+		release()
+	}
+
+	releasePkg, err := e.acquire(ctx, "pkg1", "package", 0)
+	if err != nil {
+		t.Fatalf("Failed to acquire pkg1: %s", err)
+	}
+	go acquire("pkg2", "package", 0)
+	waitPosition(t, e, "pkg2", 1)
+	// 受类型限制排队的任务不阻塞其他类型的任务
+	releaseShell, err := e.acquire(ctx, "shell", "", 0)
+	if err != nil {
+		t.Fatalf("Failed to acquire shell: %s", err)
+	}
+	go acquire("low", "", 0)
+	waitPosition(t, e, "low", 2)
+	go acquire("high", "", 1)
+	waitPosition(t, e, "high", 1)
+	if _, err := e.acquire(ctx, "rejected", "", 0); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected %v, but got %v", ErrQueueFull, err)
+	}
+
+	next := func() string {
+		select {
+		case id := <-started:
+			return id
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a task to start within 1s")
+			return ""
+		}
+	}
+	releaseShell()
+	if id := next(); id != "high" {
+		t.Fatalf("Expected the high priority task to start first, but got %s", id)
+	}
+	if id := next(); id != "low" {
+		t.Fatalf("Expected low to start while pkg1 is running, but got %s", id)
+	}
+	releasePkg()
+	if id := next(); id != "pkg2" {
+		t.Fatalf("Expected pkg2 to start after pkg1, but got %s", id)
+	}
+	deadline := time.Now().Add(time.Second)
+	for stats := e.stats(); stats.Running != 0 || stats.Queued != 0; stats = e.stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no running or queued tasks, but got %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitPosition(t *testing.T, e *executor, taskID string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for e.position(taskID) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s at position %d, but got %d", taskID, want, e.position(taskID))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
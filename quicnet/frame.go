@@ -0,0 +1,236 @@
+package quicnet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// 帧格式：4 字节大端长度，最高位为压缩标志，之后为负载；压缩的负载为 gzip 数据
+const (
+	frameHeaderSize     = 4
+	frameCompressedFlag = 1 << 31
+	frameLengthMask     = frameCompressedFlag - 1
+
+	// compressThreshold 以下的负载不压缩
+	compressThreshold = 4 << 10
+	// maxHelloFrameSize 为握手前允许的最大帧
+	maxHelloFrameSize = 64 << 10
+
+	compressionGzip = "gzip"
+)
+
+const CloseFrameTooLarge quic.ApplicationErrorCode = 0x15
+
+// FrameTooLargeError 表示帧超过了接收方允许的最大长度，连接随后会被关闭
+type FrameTooLargeError struct {
+	Size int64
+	Max  int
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("protocol error: frame of %d bytes exceeds maximum frame size %d", e.Size, e.Max)
+}
+
+// frameOptions 为一个方向上的帧参数：读取时 maxSize 为本端上限，写入时为对端上限
+type frameOptions struct {
+	maxSize  int
+	compress bool
+	stats    *frameStats
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+func compressPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writePacket(w io.Writer, data []byte, opts frameOptions) (int, error) {
+	// 对端按解压后的大小限制帧
+	if opts.maxSize > 0 && len(data) > opts.maxSize {
+		return 0, &FrameTooLargeError{Size: int64(len(data)), Max: opts.maxSize}
+	}
+	payload := data
+	compressed := false
+	if opts.compress && len(data) >= compressThreshold {
+		z, err := compressPayload(data)
+		if err != nil {
+			return 0, err
+		}
+		// 压缩后没有变小的数据按原样发送
+		if len(z) < len(data) {
+			payload, compressed = z, true
+		}
+	}
+
+	header := uint32(len(payload))
+	if compressed {
+		header |= frameCompressedFlag
+	}
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf, header)
+	buf = append(buf, payload...)
+	n, err := w.Write(buf)
+	if err == nil {
+		opts.stats.sent(len(buf), len(data), compressed)
+	}
+	return n, err
+}
+
+func readPacket(r io.Reader, opts frameOptions) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	h := binary.BigEndian.Uint32(header[:])
+	length := int64(h & frameLengthMask)
+	compressed := h&frameCompressedFlag != 0
+	if opts.maxSize > 0 && length > int64(opts.maxSize) {
+		return nil, &FrameTooLargeError{Size: length, Max: opts.maxSize}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		opts.stats.received(frameHeaderSize+len(payload), len(payload), false)
+		return payload, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("protocol error: invalid compressed frame: %w", err)
+	}
+	limit := int64(opts.maxSize)
+	if limit <= 0 {
+		limit = frameLengthMask
+	}
+	// 限制解压后的大小，避免压缩炸弹
+	data, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("protocol error: invalid compressed frame: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, &FrameTooLargeError{Size: int64(len(data)), Max: opts.maxSize}
+	}
+	opts.stats.received(frameHeaderSize+len(payload), len(data), true)
+	return data, nil
+}
+
+// FrameStats 为帧的统计数据，Bytes 为线上字节数（含帧头），PayloadBytes 为压缩前的负载字节数
+type FrameStats struct {
+	FramesSent               uint64
+	FramesReceived           uint64
+	CompressedFramesSent     uint64
+	CompressedFramesReceived uint64
+	BytesSent                uint64
+	BytesReceived            uint64
+	PayloadBytesSent         uint64
+	PayloadBytesReceived     uint64
+}
+
+type frameStats struct {
+	framesSent               atomic.Uint64
+	framesReceived           atomic.Uint64
+	compressedFramesSent     atomic.Uint64
+	compressedFramesReceived atomic.Uint64
+	bytesSent                atomic.Uint64
+	bytesReceived            atomic.Uint64
+	payloadBytesSent         atomic.Uint64
+	payloadBytesReceived     atomic.Uint64
+
+	// total 为进程内所有连接的汇总
+	total *frameStats
+}
+
+var totalFrameStats frameStats
+
+// TotalFrameStats 返回进程内所有连接的帧统计
+func TotalFrameStats() FrameStats {
+	return totalFrameStats.snapshot()
+}
+
+func (s *frameStats) sent(wire, payload int, compressed bool) {
+	for ; s != nil; s = s.total {
+		s.framesSent.Add(1)
+		s.bytesSent.Add(uint64(wire))
+		s.payloadBytesSent.Add(uint64(payload))
+		if compressed {
+			s.compressedFramesSent.Add(1)
+		}
+	}
+}
+
+func (s *frameStats) received(wire, payload int, compressed bool) {
+	for ; s != nil; s = s.total {
+		s.framesReceived.Add(1)
+		s.bytesReceived.Add(uint64(wire))
+		s.payloadBytesReceived.Add(uint64(payload))
+		if compressed {
+			s.compressedFramesReceived.Add(1)
+		}
+	}
+}
+
+func (s *frameStats) snapshot() FrameStats {
+	return FrameStats{
+		FramesSent:               s.framesSent.Load(),
+		FramesReceived:           s.framesReceived.Load(),
+		CompressedFramesSent:     s.compressedFramesSent.Load(),
+		CompressedFramesReceived: s.compressedFramesReceived.Load(),
+		BytesSent:                s.bytesSent.Load(),
+		BytesReceived:            s.bytesReceived.Load(),
+		PayloadBytesSent:         s.payloadBytesSent.Load(),
+		PayloadBytesReceived:     s.payloadBytesReceived.Load(),
+	}
+}
+
+func newFrameStats() *frameStats {
+	return &frameStats{total: &totalFrameStats}
+}
+
+// FrameStats 返回该连接（含重连前）的帧统计
+func (c *Client) FrameStats() FrameStats {
+	return c.stats.snapshot()
+}
+
+// WithMaxFrameSize 设置 agent 接受的最大帧，默认 16 MiB
+func WithMaxFrameSize(n int) ClientOption {
+	return func(c *Client) {
+		c.maxFrameSize = n
+	}
+}
+
+// WithCompression 设置是否对较大的帧使用 gzip 压缩，默认启用
+func WithCompression(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.compression = enabled
+	}
+}
+
+// WithServerMaxFrameSize 设置服务端接受的最大帧，默认 16 MiB
+func WithServerMaxFrameSize(n int) ServerOption {
+	return func(s *Server) {
+		s.maxFrameSize = n
+	}
+}
@@ -0,0 +1,72 @@
+package quicnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestFrameCompression(t *testing.T) {
+	random := make([]byte, 8<<10)
+	rand.Read(random)
+	tests := []struct {
+		name           string
+		data           []byte
+		wantCompressed bool
+	}{
+		{"small", []byte("hello"), false},
+		{"compressible", bytes.Repeat([]byte("output line\n"), 1000), true},
+		{"incompressible", random, false},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		stats := newFrameStats()
+		if _, err := writePacket(&buf, tt.data, frameOptions{compress: true, stats: stats}); err != nil {
+			t.Fatalf("Failed to write %s frame: %s", tt.name, err)
+		}
+		if got := stats.compressedFramesSent.Load() == 1; got != tt.wantCompressed {
+			t.Errorf("Expected %s frame compressed to be %v, but got %v", tt.name, tt.wantCompressed, got)
+		}
+		data, err := readPacket(&buf, frameOptions{maxSize: 1 << 20, stats: stats})
+		if err != nil {
+			t.Fatalf("Failed to read %s frame: %s", tt.name, err)
+		}
+		if !bytes.Equal(data, tt.data) {
+			t.Errorf("Expected %s frame to round trip, but got a different payload", tt.name)
+		}
+		s := stats.snapshot()
+		if s.PayloadBytesSent != uint64(len(tt.data)) || s.PayloadBytesReceived != uint64(len(tt.data)) || s.BytesSent != s.BytesReceived {
+			t.Errorf("Expected %s frame stats to count %d payload bytes, but got %+v", tt.name, len(tt.data), s)
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var tooLarge *FrameTooLargeError
+	data := make([]byte, 2048)
+
+	// 写入超过对端上限的帧在本端报错
+	if _, err := writePacket(&bytes.Buffer{}, data, frameOptions{maxSize: 1024}); !errors.As(err, &tooLarge) {
+		t.Errorf("Expected a FrameTooLargeError on write, but got %v", err)
+	}
+
+	// 对端按解压后的大小限制帧，压缩后变小的数据同样不能超过上限
+	if _, err := writePacket(&bytes.Buffer{}, make([]byte, 64<<10), frameOptions{maxSize: 1024, compress: true}); !errors.As(err, &tooLarge) {
+		t.Errorf("Expected a FrameTooLargeError for compressible data, but got %v", err)
+	}
+
+	// 帧头声明的长度超过上限时不分配内存
+	var buf bytes.Buffer
+	writePacket(&buf, data, frameOptions{})
+	if _, err := readPacket(&buf, frameOptions{maxSize: 1024}); !errors.As(err, &tooLarge) {
+		t.Errorf("Expected a FrameTooLargeError on read, but got %v", err)
+	}
+
+	// 压缩后很小但解压后超过上限
+	buf.Reset()
+	writePacket(&buf, make([]byte, 64<<10), frameOptions{compress: true})
+	if _, err := readPacket(&buf, frameOptions{maxSize: 1024}); !errors.As(err, &tooLarge) {
+		t.Errorf("Expected a FrameTooLargeError after decompression, but got %v", err)
+	}
+}
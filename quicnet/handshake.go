@@ -0,0 +1,222 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// 协议版本，不兼容的修改需要增加 ProtocolVersion，仍能兼容的最低版本为 MinProtocolVersion
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+
+	helloTimeout        = 10 * time.Second
+	refuseGracePeriod   = time.Second
+	defaultMaxFrameSize = 16 << 20
+)
+
+const CloseIncompatible quic.ApplicationErrorCode = 0x14
+
+// Version 为 agent 和服务端的版本，构建时可通过 -ldflags "-X lops/quicnet.Version=..." 设置
+var Version = "dev"
+
+// Hello 为连接建立后在第一个流上交换的第一帧，描述本端支持的协议和能力
+type Hello struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	Version            string   `json:"version"`
+	MessageTypes       []string `json:"message_types"`
+	Codecs             []string `json:"codecs"`
+	Compression        []string `json:"compression,omitempty"`
+	MaxFrameSize       int      `json:"max_frame_size"`
+}
+
+// helloReply 为服务端对 Hello 的回复，Error 不为空表示拒绝连接
+type helloReply struct {
+	Hello
+	Error string `json:"error,omitempty"`
+}
+
+// IncompatibleError 表示对端的协议版本不兼容
+type IncompatibleError struct {
+	Local  Hello
+	Remote Hello
+	Reason string
+}
+
+func (e *IncompatibleError) Error() string {
+	return "incompatible peer: " + e.Reason
+}
+
+// Capabilities 为握手后得到的对端能力
+type Capabilities struct {
+	// ProtocolVersion 为双方协商使用的协议版本
+	ProtocolVersion int
+	// Codec 为双方协商使用的编码
+	Codec        string
+	Version      string
+	MessageTypes []string
+	Codecs       []string
+	Compression  []string
+	MaxFrameSize int
+
+	codec Codec
+}
+
+func (caps *Capabilities) Supports(messageType string) bool {
+	return caps != nil && containsString(caps.MessageTypes, messageType)
+}
+
+func (h *MessageHandler) types() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	types := make([]string, 0, len(h.handlers))
+	for t := range h.handlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+// localHello 返回本端的 Hello，ack 和 cancel 由连接自身处理，所有连接都支持
+func localHello(handler *MessageHandler, codecs []string, maxFrameSize int, compression bool) Hello {
+	types := append(handler.types(), msgTypeAck, msgTypeCancel)
+	sort.Strings(types)
+	return Hello{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		Version:            Version,
+		MessageTypes:       types,
+		Codecs:             codecs,
+		Compression:        compressionList(compression),
+		MaxFrameSize:       maxFrameSize,
+	}
+}
+
+func compressionList(enabled bool) []string {
+	if !enabled {
+		return nil
+	}
+	return []string{compressionGzip}
+}
+
+// negotiate 选择双方都支持的最高协议版本
+func negotiate(local, remote Hello) (*Capabilities, error) {
+	version := local.ProtocolVersion
+	if remote.ProtocolVersion < version {
+		version = remote.ProtocolVersion
+	}
+	if version < local.MinProtocolVersion || version < remote.MinProtocolVersion {
+		return nil, &IncompatibleError{
+			Local:  local,
+			Remote: remote,
+			Reason: fmt.Sprintf("protocol versions %d-%d and %d-%d do not overlap",
+				local.MinProtocolVersion, local.ProtocolVersion, remote.MinProtocolVersion, remote.ProtocolVersion),
+		}
+	}
+	return &Capabilities{
+		ProtocolVersion: version,
+		Version:         remote.Version,
+		MessageTypes:    remote.MessageTypes,
+		Codecs:          remote.Codecs,
+		Compression:     remote.Compression,
+		MaxFrameSize:    remote.MaxFrameSize,
+	}, nil
+}
+
+// clientHello 在新建的流上发送 Hello 并等待服务端回复
+func clientHello(stream quic.Stream, local Hello) (*Capabilities, error) {
+	stream.SetDeadline(time.Now().Add(helloTimeout))
+	defer stream.SetDeadline(time.Time{})
+
+	data, err := json.Marshal(local)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writePacket(stream, data, frameOptions{}); err != nil {
+		return nil, err
+	}
+	data, err = readPacket(stream, frameOptions{maxSize: maxHelloFrameSize})
+	if err != nil {
+		return nil, err
+	}
+	var reply helloReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid hello reply: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, &IncompatibleError{Local: local, Remote: reply.Hello, Reason: reply.Error}
+	}
+	caps, err := negotiate(local, reply.Hello)
+	if err != nil {
+		return nil, err
+	}
+	if err := caps.selectCodec(local.Codecs, reply.Codecs); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// selectCodec 按 agent 的偏好选择编码，双方的选择结果相同
+func (caps *Capabilities) selectCodec(agentCodecs, serverCodecs []string) error {
+	codec := selectCodec(agentCodecs, serverCodecs)
+	if codec == nil {
+		return &IncompatibleError{Reason: fmt.Sprintf("no common codec in %v and %v", agentCodecs, serverCodecs)}
+	}
+	caps.Codec = codec.Name()
+	caps.codec = codec
+	return nil
+}
+
+// serverHello 读取 agent 的 Hello，兼容时回复服务端的 Hello，否则回复原因后返回错误
+func serverHello(stream quic.Stream, local Hello) (*Capabilities, error) {
+	stream.SetDeadline(time.Now().Add(helloTimeout))
+	defer stream.SetDeadline(time.Time{})
+
+	data, err := readPacket(stream, frameOptions{maxSize: maxHelloFrameSize})
+	if err != nil {
+		return nil, err
+	}
+	var remote Hello
+	var caps *Capabilities
+	if err = json.Unmarshal(data, &remote); err != nil || remote.ProtocolVersion == 0 {
+		// 没有握手的旧版本 agent 直接发送 Message，ProtocolVersion 为 0
+		err = &IncompatibleError{Local: local, Remote: remote, Reason: "peer did not send hello"}
+	} else if caps, err = negotiate(local, remote); err == nil {
+		err = caps.selectCodec(remote.Codecs, local.Codecs)
+	}
+	reply := helloReply{Hello: local}
+	var incompatible *IncompatibleError
+	if errors.As(err, &incompatible) {
+		reply.Error = incompatible.Reason
+	}
+	if werr := writeHelloReply(stream, reply); werr != nil && err == nil {
+		err = werr
+	}
+	return caps, err
+}
+
+func writeHelloReply(stream quic.Stream, reply helloReply) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	_, err = writePacket(stream, data, frameOptions{})
+	return err
+}
+
+// PeerCapabilities 返回当前连接上对端在握手时声明的能力
+func (c *Client) PeerCapabilities() *Capabilities {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.peer
+}
+
+// PeerSupports 判断对端是否支持 messageType，发送新增的消息类型前应先检查
+func (c *Client) PeerSupports(messageType string) bool {
+	return c.PeerCapabilities().Supports(messageType)
+}
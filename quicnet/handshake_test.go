@@ -0,0 +1,39 @@
+package quicnet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		localMin, localMax   int
+		remoteMin, remoteMax int
+		expected             int
+	}{
+		{1, 1, 1, 1, 1},
+		{1, 3, 1, 2, 2},
+		{2, 3, 1, 4, 3},
+		{1, 1, 2, 2, 0},
+		{3, 4, 1, 2, 0},
+	}
+	for _, tt := range tests {
+		local := Hello{MinProtocolVersion: tt.localMin, ProtocolVersion: tt.localMax}
+		remote := Hello{MinProtocolVersion: tt.remoteMin, ProtocolVersion: tt.remoteMax, MessageTypes: []string{"heartbeat"}}
+		caps, err := negotiate(local, remote)
+		if tt.expected == 0 {
+			var incompatible *IncompatibleError
+			if !errors.As(err, &incompatible) {
+				t.Errorf("Expected %d-%d vs %d-%d to be incompatible, but got %v", tt.localMin, tt.localMax, tt.remoteMin, tt.remoteMax, err)
+			}
+			continue
+		}
+		if err != nil || caps.ProtocolVersion != tt.expected {
+			t.Errorf("Expected %d-%d vs %d-%d to negotiate version %d, but got %+v (error: %v)", tt.localMin, tt.localMax, tt.remoteMin, tt.remoteMax, tt.expected, caps, err)
+			continue
+		}
+		if !caps.Supports("heartbeat") || caps.Supports("script_task") {
+			t.Errorf("Expected only heartbeat to be supported, but got %v", caps.MessageTypes)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package quicnet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer 在随机端口上启动使用自签名证书的服务端，测试结束时关闭
+func newTestServer(t *testing.T, opts ...ServerOption) *Server {
+	t.Helper()
+	return startTestServer(t, "127.0.0.1:0", opts...)
+}
+
+func startTestServer(t *testing.T, addr string, opts ...ServerOption) *Server {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate server key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lops test server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create server certificate: %s", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{NextProto},
+	}
+	s, err := NewServer(addr, tlsCfg, nil, opts...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	go s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testServerAddr(s *Server) string {
+	return s.listener.Addr().String()
+}
+
+func testClientTLS() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, NextProtos: []string{NextProto}}
+}
+
+// withMachineID 使同一台机器上的多个测试 agent 使用不同的 MachineID
+func withMachineID(machineID string) ClientOption {
+	return func(c *Client) {
+		c.MachineID = machineID
+	}
+}
+
+// newTestClient 连接 s 并等待服务端完成注册，测试结束时关闭
+func newTestClient(t *testing.T, s *Server, opts ...ClientOption) *Client {
+	t.Helper()
+	c, err := NewClient(testServerAddr(s), testClientTLS(), nil, opts...)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %s", err)
+	}
+	t.Cleanup(c.Close)
+	eventually(t, 3*time.Second, func() bool {
+		client := s.ClientManager().GetClient(c.MachineID)
+		return client != nil
+	})
+	return c
+}
+
+// eventually 在 timeout 内轮询 cond，超时仍不满足时测试失败
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected condition to be met within %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
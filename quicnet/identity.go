@@ -0,0 +1,143 @@
+package quicnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"os"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// NextProto 为 lops 使用的 ALPN 协议名
+const NextProto = "lops"
+
+// 关闭连接时使用的应用错误码
+const (
+	CloseNormal           quic.ApplicationErrorCode = 0
+	CloseIdentityMismatch quic.ApplicationErrorCode = 0x10
+	CloseUnauthenticated  quic.ApplicationErrorCode = 0x11
+	CloseKeyRejected      quic.ApplicationErrorCode = 0x12
+	CloseRevoked          quic.ApplicationErrorCode = 0x13
+)
+
+// OIDMachineID 为证书中携带 MachineID 的扩展，值为 UTF8String
+var OIDMachineID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59425, 1, 1}
+
+// machineIDURIScheme 为 SAN 中携带 MachineID 的 URI 的 scheme，例如 machine:fed6b2924c42
+const machineIDURIScheme = "machine"
+
+var ErrNoMachineID = errors.New("certificate does not carry a machine id")
+
+// PeerIdentity 是从已校验的客户端证书中得到的 agent 身份
+type PeerIdentity struct {
+	MachineID    string
+	CommonName   string
+	SerialNumber string
+	// Fingerprint 为证书 DER 的 SHA-256，十六进制
+	Fingerprint string
+	// PublicKeyFingerprint 为证书公钥的 SHA-256，证书续期时保持不变
+	PublicKeyFingerprint string
+	Certificate          *x509.Certificate
+}
+
+// IdentityFunc 从已校验的客户端证书中取出 MachineID
+type IdentityFunc func(cert *x509.Certificate) (string, error)
+
+// MachineIDFromCertificate 依次从 OIDMachineID 扩展、machine: URI SAN 和 CommonName 中取 MachineID
+func MachineIDFromCertificate(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDMachineID) {
+			continue
+		}
+		var machineID string
+		if _, err := asn1.UnmarshalWithParams(ext.Value, &machineID, "utf8"); err != nil {
+			return "", fmt.Errorf("invalid machine id extension: %w", err)
+		}
+		return machineID, nil
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme == machineIDURIScheme && uri.Opaque != "" {
+			return uri.Opaque, nil
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	return "", ErrNoMachineID
+}
+
+func newPeerIdentity(cert *x509.Certificate, identityFunc IdentityFunc) (*PeerIdentity, error) {
+	machineID, err := identityFunc(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerIdentity{
+		MachineID:            machineID,
+		CommonName:           cert.Subject.CommonName,
+		SerialNumber:         cert.SerialNumber.Text(16),
+		Fingerprint:          certFingerprint(cert),
+		PublicKeyFingerprint: publicKeyFingerprint(cert.RawSubjectPublicKeyInfo),
+		Certificate:          cert,
+	}, nil
+}
+
+// peerIdentity 返回连接上已校验的客户端证书对应的身份，没有客户端证书时返回 nil
+func peerIdentity(session quic.Connection, identityFunc IdentityFunc) (*PeerIdentity, error) {
+	state := session.ConnectionState().TLS
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	return newPeerIdentity(state.PeerCertificates[0], identityFunc)
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig 创建要求 agent 提供由 caFile 签发的客户端证书的服务端 TLS 配置
+func NewServerTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{NextProto},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// NewClientTLSConfig 创建使用客户端证书并用 caFile 校验服务端的 agent TLS 配置
+func NewClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		NextProtos:   []string{NextProto},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package quicnet
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/url"
+	"testing"
+)
+
+func TestMachineIDFromCertificate(t *testing.T) {
+	ext, err := asn1.MarshalWithParams("ext-id", "utf8")
+	if err != nil {
+		t.Fatalf("Failed to marshal machine id extension: %s", err)
+	}
+	uri, _ := url.Parse("machine:uri-id")
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		expected string
+	}{
+		{"extension", &x509.Certificate{
+			Extensions: []pkix.Extension{{Id: OIDMachineID, Value: ext}},
+			URIs:       []*url.URL{uri},
+			Subject:    pkix.Name{CommonName: "cn-id"},
+		}, "ext-id"},
+		{"uri", &x509.Certificate{URIs: []*url.URL{uri}, Subject: pkix.Name{CommonName: "cn-id"}}, "uri-id"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "cn-id"}}, "cn-id"},
+	}
+	for _, tt := range tests {
+		machineID, err := MachineIDFromCertificate(tt.cert)
+		if err != nil || machineID != tt.expected {
+			t.Errorf("Expected machine id %q from %s, but got %q (error: %v)", tt.expected, tt.name, machineID, err)
+		}
+	}
+	if _, err := MachineIDFromCertificate(&x509.Certificate{}); err != ErrNoMachineID {
+		t.Errorf("Expected %v for an empty certificate, but got %v", ErrNoMachineID, err)
+	}
+}
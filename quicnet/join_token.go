@@ -0,0 +1,265 @@
+package quicnet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenInvalid   = errors.New("invalid join token")
+	ErrTokenExpired   = errors.New("join token expired")
+	ErrTokenExhausted = errors.New("join token has no uses left")
+	ErrTokenRevoked   = errors.New("join token revoked")
+	ErrTokenNotFound  = errors.New("join token not found")
+	ErrTokenMachine   = errors.New("join token is bound to another machine")
+)
+
+// JoinToken 是 agent 入网使用的令牌，令牌本身为 "<ID>.<secret>"，服务端只保存 secret 的哈希
+type JoinToken struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	// ExpiresAt 为零值时不过期
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// MaxUses 为可使用次数，小于 0 表示不限
+	MaxUses int  `json:"max_uses"`
+	Uses    int  `json:"uses"`
+	Revoked bool `json:"revoked,omitempty"`
+	// MachineID 不为空时令牌只能用于该 agent 入网，已入网或已吊销的 agent 只能用这样的令牌重新入网
+	MachineID string `json:"machine_id,omitempty"`
+}
+
+type TokenOptions struct {
+	Description string
+	// TTL 为有效期，0 表示不过期
+	TTL time.Duration
+	// MaxUses 为可使用次数，0 表示一次性令牌，小于 0 表示不限
+	MaxUses int
+	// MachineID 将令牌绑定到该 agent，用于更换密钥或吊销后重新入网
+	MachineID string
+}
+
+type tokenRecord struct {
+	JoinToken
+	SecretHash string `json:"secret_hash"`
+	// Machines 为使用该令牌入网的 agent
+	Machines []string `json:"machines,omitempty"`
+}
+
+// TokenStore 管理入网令牌并保存在 JSON 文件中
+type TokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*tokenRecord
+}
+
+// OpenTokenStore 打开 path 对应的令牌文件，文件不存在时创建空的令牌表
+func OpenTokenStore(path string) (*TokenStore, error) {
+	ts := &TokenStore{path: path, tokens: make(map[string]*tokenRecord)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*tokenRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		ts.tokens[r.ID] = r
+	}
+	return ts, nil
+}
+
+// Create 创建令牌，返回的令牌字符串只在此时可见
+func (ts *TokenStore) Create(opts TokenOptions) (string, JoinToken, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return "", JoinToken{}, err
+	}
+	secret, err := randomHex(16)
+	if err != nil {
+		return "", JoinToken{}, err
+	}
+	maxUses := opts.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	r := &tokenRecord{
+		JoinToken: JoinToken{
+			ID:          id,
+			Description: opts.Description,
+			CreatedAt:   time.Now(),
+			MaxUses:     maxUses,
+			MachineID:   opts.MachineID,
+		},
+		SecretHash: hashSecret(secret),
+	}
+	if opts.TTL > 0 {
+		r.ExpiresAt = r.CreatedAt.Add(opts.TTL)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens[id] = r
+	if err := ts.save(); err != nil {
+		delete(ts.tokens, id)
+		return "", JoinToken{}, err
+	}
+	return id + "." + secret, r.JoinToken, nil
+}
+
+// List 按创建时间返回所有令牌，包括已撤销和已用尽的令牌
+func (ts *TokenStore) List() []JoinToken {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens := make([]JoinToken, 0, len(ts.tokens))
+	for _, r := range ts.tokens {
+		tokens = append(tokens, r.JoinToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Revoke 撤销令牌，撤销后的令牌不能再用于入网
+func (ts *TokenStore) Revoke(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	r, ok := ts.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	r.Revoked = true
+	return ts.save()
+}
+
+// check 校验 machineID 能否使用令牌入网，不记录使用
+func (ts *TokenStore) check(token, machineID string) (JoinToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	r, err := ts.validate(token, machineID)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	return r.JoinToken, nil
+}
+
+// consume 校验令牌并记录 machineID 的一次使用
+func (ts *TokenStore) consume(token, machineID string) (JoinToken, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	r, err := ts.validate(token, machineID)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	r.Uses++
+	r.Machines = append(r.Machines, machineID)
+	if err := ts.save(); err != nil {
+		r.Uses--
+		r.Machines = r.Machines[:len(r.Machines)-1]
+		return JoinToken{}, err
+	}
+	return r.JoinToken, nil
+}
+
+func (ts *TokenStore) validate(token, machineID string) (*tokenRecord, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrTokenInvalid
+	}
+	r, ok := ts.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(r.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrTokenInvalid
+	}
+	switch {
+	case r.Revoked:
+		return nil, ErrTokenRevoked
+	case !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt):
+		return nil, ErrTokenExpired
+	case r.MaxUses >= 0 && r.Uses >= r.MaxUses:
+		return nil, ErrTokenExhausted
+	case r.MachineID != "" && r.MachineID != machineID:
+		return nil, ErrTokenMachine
+	}
+	return r, nil
+}
+
+// enrolled 判断 machineID 是否已用令牌入网
+func (ts *TokenStore) enrolled(machineID string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, r := range ts.tokens {
+		for _, id := range r.Machines {
+			if id == machineID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ts *TokenStore) save() error {
+	records := make([]*tokenRecord, 0, len(ts.tokens))
+	for _, r := range ts.tokens {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ts.path, data, 0600)
+}
+
+// writeFileAtomic 先写临时文件再重命名，避免进程中断留下不完整的文件
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
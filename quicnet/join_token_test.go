@@ -0,0 +1,82 @@
+package quicnet
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	ts, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open token store: %s", err)
+	}
+	once, _, err := ts.Create(TokenOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create token: %s", err)
+	}
+	twice, _, _ := ts.Create(TokenOptions{MaxUses: 2})
+	expired, _, _ := ts.Create(TokenOptions{TTL: time.Nanosecond})
+	revoked, tok, _ := ts.Create(TokenOptions{MaxUses: -1})
+	if err := ts.Revoke(tok.ID); err != nil {
+		t.Fatalf("Failed to revoke token: %s", err)
+	}
+
+	if _, err := ts.consume(once, "m1"); err != nil {
+		t.Fatalf("Expected one-time token to be accepted, but got %s", err)
+	}
+	if _, err := ts.consume(once, "m2"); err != ErrTokenExhausted {
+		t.Errorf("Expected reused one-time token to fail with %v, but got %v", ErrTokenExhausted, err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := ts.consume(expired, "m2"); err != ErrTokenExpired {
+		t.Errorf("Expected expired token to fail with %v, but got %v", ErrTokenExpired, err)
+	}
+	if _, err := ts.consume(revoked, "m2"); err != ErrTokenRevoked {
+		t.Errorf("Expected revoked token to fail with %v, but got %v", ErrTokenRevoked, err)
+	}
+	if _, err := ts.consume(tok.ID+".wrong", "m2"); err != ErrTokenInvalid {
+		t.Errorf("Expected wrong secret to fail with %v, but got %v", ErrTokenInvalid, err)
+	}
+
+	// 重新打开后使用次数、撤销状态和入网记录保持不变
+	ts, err = OpenTokenStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen token store: %s", err)
+	}
+	if _, err := ts.consume(twice, "m2"); err != nil {
+		t.Fatalf("Expected two-use token to be accepted, but got %s", err)
+	}
+	if _, err := ts.consume(once, "m3"); err != ErrTokenExhausted {
+		t.Errorf("Expected one-time token to stay used after reopen, but got %v", err)
+	}
+	if _, err := ts.consume(revoked, "m3"); err != ErrTokenRevoked {
+		t.Errorf("Expected token to stay revoked after reopen, but got %v", err)
+	}
+	if !ts.enrolled("m1") || !ts.enrolled("m2") || ts.enrolled("m3") {
+		t.Errorf("Expected m1 and m2 to be enrolled and m3 not")
+	}
+	if n := len(ts.List()); n != 4 {
+		t.Errorf("Expected 4 tokens, but got %d", n)
+	}
+}
+
+func TestTokenBoundToMachine(t *testing.T) {
+	ts, err := OpenTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Failed to open token store: %s", err)
+	}
+	bound, _, _ := ts.Create(TokenOptions{MachineID: "m1"})
+
+	if _, err := ts.check(bound, "m2"); err != ErrTokenMachine {
+		t.Errorf("Expected token bound to m1 to be refused for m2, but got %v", err)
+	}
+	// check 不记录使用
+	if _, err := ts.check(bound, "m1"); err != nil {
+		t.Errorf("Expected token bound to m1 to be accepted, but got %v", err)
+	}
+	if tok, err := ts.consume(bound, "m1"); err != nil || tok.MachineID != "m1" {
+		t.Errorf("Expected token bound to m1 to be consumed, but got %+v, %v", tok, err)
+	}
+}
@@ -0,0 +1,362 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type KeyState string
+
+const (
+	KeyPending  KeyState = "pending"
+	KeyAccepted KeyState = "accepted"
+	KeyRejected KeyState = "rejected"
+)
+
+var (
+	ErrKeyNotFound      = errors.New("agent key not found")
+	ErrKeyMismatch      = errors.New("agent key does not match the stored key")
+	ErrKeyRejected      = errors.New("agent key rejected")
+	ErrAgentNotAccepted = errors.New("agent not accepted")
+)
+
+// AgentKey 记录 agent 的身份及其接受状态。Fingerprint 为证书公钥的 SHA-256，
+// 不使用客户端证书时为空，此时只能按 MachineID 识别 agent
+type AgentKey struct {
+	MachineID   string    `json:"machine_id"`
+	Hostname    string    `json:"hostname,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	EnrollToken string    `json:"enroll_token,omitempty"`
+	State       KeyState  `json:"state"`
+	FirstSeen   time.Time `json:"first_seen"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// AutoAcceptFunc 决定新出现的 agent 是否自动接受，attrs 为 agent 心跳中的属性
+type AutoAcceptFunc func(key AgentKey, attrs map[string]string) bool
+
+// AcceptAll 自动接受所有 agent
+func AcceptAll() AutoAcceptFunc {
+	return func(AgentKey, map[string]string) bool { return true }
+}
+
+// AcceptSelector 自动接受属性匹配选择器表达式的 agent。标签由 agent 自行上报，
+// 只适合在 agent 身份已由证书保证的环境中使用
+func AcceptSelector(expr string) (AutoAcceptFunc, error) {
+	selector, err := ParseSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ AgentKey, attrs map[string]string) bool {
+		return selector.Match(attrs)
+	}, nil
+}
+
+// AcceptTokens 自动接受使用指定入网令牌入网的 agent
+func AcceptTokens(tokenIDs ...string) AutoAcceptFunc {
+	ids := make(map[string]bool, len(tokenIDs))
+	for _, id := range tokenIDs {
+		ids[id] = true
+	}
+	return func(key AgentKey, _ map[string]string) bool {
+		return key.EnrollToken != "" && ids[key.EnrollToken]
+	}
+}
+
+// KeyStore 保存 agent 的身份和接受状态，path 为空时只保存在内存中
+type KeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]*AgentKey
+}
+
+func OpenKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path, keys: make(map[string]*AgentKey)}
+	if path == "" {
+		return ks, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*AgentKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		ks.keys[k.MachineID] = k
+	}
+	return ks, nil
+}
+
+func (ks *KeyStore) Get(machineID string) (AgentKey, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[machineID]
+	if !ok {
+		return AgentKey{}, false
+	}
+	return *k, true
+}
+
+// List 返回指定状态的 key，不指定状态时返回全部
+func (ks *KeyStore) List(states ...KeyState) []AgentKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	var keys []AgentKey
+	for _, k := range ks.keys {
+		if len(states) > 0 && !containsKeyState(states, k.State) {
+			continue
+		}
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].MachineID < keys[j].MachineID
+	})
+	return keys
+}
+
+func (ks *KeyStore) setState(machineID string, state KeyState) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[machineID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if k.State == state {
+		return nil
+	}
+	prev := k.State
+	k.State = state
+	k.UpdatedAt = time.Now()
+	if err := ks.save(); err != nil {
+		k.State = prev
+		return err
+	}
+	return nil
+}
+
+func (ks *KeyStore) delete(machineID string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[machineID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	delete(ks.keys, machineID)
+	if err := ks.save(); err != nil {
+		ks.keys[machineID] = k
+		return err
+	}
+	return nil
+}
+
+// observe 记录一次 agent 登记，新 agent 以 pending 状态加入。公钥与已保存的不一致或已被拒绝时返回错误，
+// 需要运维删除旧 key 后才能以新 key 重新登记
+func (ks *KeyStore) observe(machineID, fingerprint, hostname string) (AgentKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[machineID]
+	if !ok {
+		now := time.Now()
+		k = &AgentKey{
+			MachineID:   machineID,
+			Hostname:    hostname,
+			Fingerprint: fingerprint,
+			State:       KeyPending,
+			FirstSeen:   now,
+			UpdatedAt:   now,
+		}
+		ks.keys[machineID] = k
+		if err := ks.save(); err != nil {
+			log.Printf("Failed to save key store: %s", err)
+		}
+		return *k, nil
+	}
+	if k.Fingerprint != fingerprint {
+		return *k, ErrKeyMismatch
+	}
+	if k.State == KeyRejected {
+		return *k, ErrKeyRejected
+	}
+	if k.Hostname != hostname {
+		k.Hostname = hostname
+		k.UpdatedAt = time.Now()
+		if err := ks.save(); err != nil {
+			log.Printf("Failed to save key store: %s", err)
+		}
+	}
+	return *k, nil
+}
+
+// noteEnrollment 在 agent 入网时预先登记其公钥和使用的令牌，供自动接受策略使用。
+// replace 为 true 时（使用绑定到该 agent 的令牌重新入网）以新公钥替换已有记录，需重新接受
+func (ks *KeyStore) noteEnrollment(machineID, fingerprint, hostname, tokenID string, replace bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.keys[machineID]; ok && !replace {
+		return
+	}
+	now := time.Now()
+	ks.keys[machineID] = &AgentKey{
+		MachineID:   machineID,
+		Hostname:    hostname,
+		Fingerprint: fingerprint,
+		EnrollToken: tokenID,
+		State:       KeyPending,
+		FirstSeen:   now,
+		UpdatedAt:   now,
+	}
+	if err := ks.save(); err != nil {
+		log.Printf("Failed to save key store: %s", err)
+	}
+}
+
+func (ks *KeyStore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	keys := make([]*AgentKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].MachineID < keys[j].MachineID
+	})
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ks.path, data, 0600)
+}
+
+func containsKeyState(states []KeyState, state KeyState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// WithKeyStore 要求运维接受新出现的 agent 后才能向其下发任务，autoAccept 为 nil 时全部需要手动接受
+func WithKeyStore(ks *KeyStore, autoAccept AutoAcceptFunc) ServerOption {
+	return func(s *Server) {
+		s.cm.SetKeyStore(ks, autoAccept)
+	}
+}
+
+func (cm *ClientManager) SetKeyStore(ks *KeyStore, autoAccept AutoAcceptFunc) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.keys = ks
+	cm.autoAccept = autoAccept
+}
+
+// admit 在 agent 登记前检查其 key，返回 agent 当前的接受状态。未设置 KeyStore 时所有 agent 均视为已接受
+func (cm *ClientManager) admit(client *Client, heartbeatData *HeartbeatData) (KeyState, error) {
+	cm.mu.RLock()
+	ks, autoAccept := cm.keys, cm.autoAccept
+	cm.mu.RUnlock()
+	if ks == nil {
+		return KeyAccepted, nil
+	}
+
+	var fingerprint string
+	if client.Identity != nil {
+		fingerprint = client.Identity.PublicKeyFingerprint
+	}
+	key, err := ks.observe(heartbeatData.MachineID, fingerprint, heartbeatData.Hostname)
+	if err != nil {
+		return key.State, err
+	}
+	if key.State == KeyPending && autoAccept != nil {
+		attrs := makeAttributes(heartbeatData.Labels, heartbeatData.Facts, heartbeatData.MachineID, heartbeatData.Hostname, heartbeatData.IP)
+		if autoAccept(key, attrs) {
+			if err := ks.setState(key.MachineID, KeyAccepted); err != nil {
+				return key.State, err
+			}
+			log.Printf("Auto-accepted agent %s", key.MachineID)
+			return KeyAccepted, nil
+		}
+	}
+	return key.State, nil
+}
+
+// Accepted 判断 agent 是否已被接受，只有已接受的 agent 可以接收任务
+func (cm *ClientManager) Accepted(machineID string) bool {
+	ks := cm.keyStore()
+	if ks == nil {
+		return true
+	}
+	return ks.accepted(machineID)
+}
+
+// Keys 返回指定状态的 agent key，未设置 KeyStore 时返回 nil
+func (cm *ClientManager) Keys(states ...KeyState) []AgentKey {
+	ks := cm.keyStore()
+	if ks == nil {
+		return nil
+	}
+	return ks.List(states...)
+}
+
+// Accept 接受 agent，之后可以向其下发任务
+func (cm *ClientManager) Accept(machineID string) error {
+	ks := cm.keyStore()
+	if ks == nil {
+		return ErrKeyNotFound
+	}
+	return ks.setState(machineID, KeyAccepted)
+}
+
+// Reject 拒绝 agent 并断开其连接，被拒绝的 agent 再次连接时会被直接断开
+func (cm *ClientManager) Reject(machineID string) error {
+	ks := cm.keyStore()
+	if ks == nil {
+		return ErrKeyNotFound
+	}
+	if err := ks.setState(machineID, KeyRejected); err != nil {
+		return err
+	}
+	if client := cm.GetClient(machineID); client != nil {
+		client.CloseWithError(CloseKeyRejected, "agent key rejected")
+	}
+	return nil
+}
+
+// DeleteKey 删除 agent 的 key 并断开其连接，agent 重新连接后以新 key 进入 pending 状态
+func (cm *ClientManager) DeleteKey(machineID string) error {
+	ks := cm.keyStore()
+	if ks == nil {
+		return ErrKeyNotFound
+	}
+	if err := ks.delete(machineID); err != nil {
+		return err
+	}
+	if client := cm.GetClient(machineID); client != nil {
+		client.CloseWithError(CloseKeyRejected, "agent key deleted")
+	}
+	return nil
+}
+
+func (cm *ClientManager) keyStore() *KeyStore {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.keys
+}
+
+func (ks *KeyStore) accepted(machineID string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[machineID]
+	return ok && k.State == KeyAccepted
+}
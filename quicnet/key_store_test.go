@@ -0,0 +1,48 @@
+package quicnet
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	ks, err := OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open key store: %s", err)
+	}
+	k, err := ks.observe("m1", "fp1", "host1")
+	if err != nil || k.State != KeyPending {
+		t.Fatalf("Expected a new key to be pending, but got %+v (error: %v)", k, err)
+	}
+	if _, err := ks.observe("m1", "fp2", "host1"); err != ErrKeyMismatch {
+		t.Errorf("Expected %v for a different key, but got %v", ErrKeyMismatch, err)
+	}
+	if err := ks.setState("m1", KeyAccepted); err != nil {
+		t.Fatalf("Failed to accept m1: %s", err)
+	}
+	ks.observe("m2", "", "host2")
+	if err := ks.setState("m2", KeyRejected); err != nil {
+		t.Fatalf("Failed to reject m2: %s", err)
+	}
+
+	ks, err = OpenKeyStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen key store: %s", err)
+	}
+	if !ks.accepted("m1") {
+		t.Errorf("Expected m1 to stay accepted after reopen")
+	}
+	if _, err := ks.observe("m2", "", "host2"); err != ErrKeyRejected {
+		t.Errorf("Expected %v for a rejected key, but got %v", ErrKeyRejected, err)
+	}
+	if keys := ks.List(KeyRejected); len(keys) != 1 || keys[0].MachineID != "m2" {
+		t.Errorf("Expected only m2 to be rejected, but got %+v", keys)
+	}
+	if err := ks.delete("m2"); err != nil {
+		t.Fatalf("Failed to delete m2: %s", err)
+	}
+	if k, err := ks.observe("m2", "fp3", "host2"); err != nil || k.State != KeyPending {
+		t.Errorf("Expected a deleted key to be pending again, but got %+v (error: %v)", k, err)
+	}
+}
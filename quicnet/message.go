@@ -1,35 +1,90 @@
 package quicnet
 
 import (
-	"encoding/json"
+	"context"
+	"time"
 )
 
 type Message struct {
 	ID   string `json:"id"`
 	Type string `json:"type"`
 	Data []byte `json:"data"`
+
+	// ReplyTo 为被回复请求的 ID，非空表示这是一条回复
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	WantReply bool      `json:"want_reply,omitempty"`
+	// NeedAck 表示接收方处理后需回复 ack，发送方收到 ack 前会保留该消息
+	NeedAck bool `json:"need_ack,omitempty"`
+	// Deadline 为请求方放弃等待的时间（Unix 毫秒），0 表示不限
+	Deadline int64 `json:"deadline,omitempty"`
+
+	ctx context.Context
+	// stream 为消息所在的独占流，为空表示控制流
+	stream *msgStream
+}
+
+// Context 返回请求的上下文，发送方取消或超过 Deadline 后会被取消
+func (m *Message) Context() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
+func (m *Message) IsReply() bool {
+	return m.ReplyTo != ""
 }
 
+// Err 返回回复中携带的错误
+func (m *Message) Err() error {
+	if m.Code == "" {
+		return nil
+	}
+	return &RemoteError{Code: m.Code, Message: m.Error}
+}
+
+func (m *Message) deadline() (time.Time, bool) {
+	if m.Deadline == 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(m.Deadline), true
+}
+
+// Marshal 使用 JSONCodec 编码，连接上实际使用的编码由握手协商
 func (m *Message) Marshal() ([]byte, error) {
-	return json.Marshal(m)
+	return JSONCodec.Marshal(m)
 }
 
 func UnmarshalMessage(data []byte) (*Message, error) {
-	var msg Message
-	err := json.Unmarshal(data, &msg)
-	if err != nil {
-		return nil, err
-	}
-	return &msg, nil
+	return JSONCodec.Unmarshal(data)
 }
 
 type ScriptTaskRequest struct {
-	TaskID       string            `json:"task_id"`
-	Type         string            `json:"type"`
-	Content      string            `json:"content"`
-	Params       map[string]string `json:"params"`
-	Timeout      int               `json:"timeout"`
-	Interpreter  string            `json:"interpreter"`
-	Stdin        string            `json:"stdin"`
+	TaskID      string            `json:"task_id"`
+	Type        string            `json:"type"`
+	Content     string            `json:"content"`
+	Params      map[string]string `json:"params"`
+	Timeout     int               `json:"timeout"`
+	Interpreter string            `json:"interpreter"`
+	Stdin       string            `json:"stdin"`
+	// StreamOutput 为 true 时 agent 在脚本运行中实时发送输出，见 Server.SubscribeOutput
+	StreamOutput bool `json:"stream_output,omitempty"`
+	// Priority 为任务在 agent 上排队时的优先级，数值大的先运行
+	Priority int `json:"priority,omitempty"`
+	// User、Group 为运行脚本的用户和用户组，需要 agent 以 root 运行
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Dir 为脚本的工作目录，为空时使用 agent 的工作目录
+	Dir string `json:"dir,omitempty"`
+	// Umask 为八进制的 umask，例如 "022"
+	Umask string `json:"umask,omitempty"`
+	// Nice 为脚本进程相对 agent 的优先级调整（nice -n），小于 0 时脚本需要以 root 运行
+	Nice   int             `json:"nice,omitempty"`
+	Limits *ResourceLimits `json:"limits,omitempty"`
+	// GracePeriod 为超时或取消时从 SIGTERM 到 SIGKILL 的秒数，默认为 5 秒
+	GracePeriod int `json:"grace_period,omitempty"`
+	// Cgroup 为脚本的 cgroup v2 资源上限，agent 不支持 cgroup v2 时不生效
+	Cgroup *CgroupLimits `json:"cgroup,omitempty"`
 }
-
@@ -2,43 +2,96 @@ package quicnet
 
 import (
 	"log"
+	"sync"
 )
 
+// HandlerFunc 处理对端发来的消息；无人等待的迟到回复（IsReply 为 true）也会交给同类型的处理函数。
+// 处理函数返回错误且请求方在等待回复时，会自动回复该错误
 type HandlerFunc func(request *Message, client *Client) error
 
 type MessageHandler struct {
+	mu       sync.RWMutex
 	handlers map[string]HandlerFunc
-	in       chan *Message
+	in       chan *clientMessage
+}
+
+// clientMessage 记录消息来自哪个连接，服务端所有连接共用一个 MessageHandler
+type clientMessage struct {
+	msg    *Message
+	client *Client
 }
 
 func NewMessageHandler(bufferSize int) *MessageHandler {
 	return &MessageHandler{
 		handlers: make(map[string]HandlerFunc),
-		in:       make(chan *Message, bufferSize),
+		in:       make(chan *clientMessage, bufferSize),
 	}
 }
 
 func (h *MessageHandler) RegisterHandler(messageType string, handler HandlerFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.handlers[messageType] = handler
 }
 
+func (h *MessageHandler) handler(messageType string) (HandlerFunc, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	handler, ok := h.handlers[messageType]
+	return handler, ok
+}
+
+// HandleMessages 启动 numWorkers 个 worker 处理消息，client 为未指定来源连接的消息的默认连接
 func (h *MessageHandler) HandleMessages(client *Client, numWorkers int) {
 	for i := 0; i < numWorkers; i++ {
 		go func() {
-			for msg := range h.in {
-				if handler, ok := h.handlers[msg.Type]; ok {
-					err := handler(msg, client)
-					if err != nil {
-						log.Printf("Error handling message: %s", err)
-					}
-				} else {
-					log.Printf("No handler registered for message type: %s", msg.Type)
+			for cm := range h.in {
+				c := cm.client
+				if c == nil {
+					c = client
 				}
+				h.handle(cm.msg, c)
 			}
 		}()
 	}
 }
 
+func (h *MessageHandler) handle(msg *Message, c *Client) {
+	defer c.rpc.finish(msg.ID)
+	if msg.IsReply() {
+		defer c.sendAck(msg)
+	}
+
+	if err := msg.Context().Err(); err != nil {
+		log.Printf("Abandon message %s (%s): %s", msg.ID, msg.Type, err)
+		return
+	}
+
+	handler, ok := h.handler(msg.Type)
+	if !ok {
+		if msg.IsReply() {
+			return
+		}
+		log.Printf("No handler registered for message type: %s", msg.Type)
+		if msg.WantReply {
+			c.ReplyError(msg, NewRemoteError(ErrCodeNoHandler, "no handler for message type %s", msg.Type))
+		}
+		return
+	}
+
+	if err := handler(msg, c); err != nil {
+		log.Printf("Error handling message: %s", err)
+		// 请求方已取消或超时则无需回复
+		if msg.WantReply && msg.Context().Err() == nil {
+			c.ReplyError(msg, err)
+		}
+	}
+}
+
 func (h *MessageHandler) SubmitMessage(msg *Message) {
-	h.in <- msg
+	h.in <- &clientMessage{msg: msg}
+}
+
+func (h *MessageHandler) SubmitClientMessage(client *Client, msg *Message) {
+	h.in <- &clientMessage{msg: msg, client: client}
 }
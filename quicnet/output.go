@@ -0,0 +1,325 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const msgTypeTaskOutput = "task_output"
+
+const (
+	// maxOutputChunk 为单个输出块的最大字节数
+	maxOutputChunk = 32 << 10
+	// maxPendingOutput 为每个任务等待前序输出块时最多缓存的字节数，超过后跳过缺失的部分
+	maxPendingOutput = 4 << 20
+)
+
+type OutputStream string
+
+const (
+	OutputStdout OutputStream = "stdout"
+	OutputStderr OutputStream = "stderr"
+)
+
+// OutputChunk 为脚本运行中产生的一段输出。Offset 为该段在所属输出流中的字节偏移，
+// Seq 在同一任务的 stdout 和 stderr 之间递增，可用于还原两者的先后顺序
+type OutputChunk struct {
+	TaskID string `json:"task_id"`
+	// MachineID 为产生该输出的 agent，由服务端在转发给订阅者前填写
+	MachineID string       `json:"machine_id,omitempty"`
+	Stream    OutputStream `json:"stream"`
+	Seq       uint64       `json:"seq"`
+	Offset    int64        `json:"offset"`
+	Data      []byte       `json:"data"`
+	Time      time.Time    `json:"time"`
+}
+
+// outputWriter 收集脚本的一路输出，任务设置了 Output 时同时将写入的数据作为输出块发出
+type outputWriter struct {
+	task   *ScriptTask
+	stream OutputStream
+	buf    strings.Builder
+	offset int64
+}
+
+func newOutputWriter(task *ScriptTask, stream OutputStream) *outputWriter {
+	return &outputWriter{task: task, stream: stream}
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for data := p; len(data) > 0; {
+		n := len(data)
+		if n > maxOutputChunk {
+			n = maxOutputChunk
+		}
+		if w.task.Output != nil {
+			w.task.Output(OutputChunk{
+				TaskID: w.task.TaskID,
+				Stream: w.stream,
+				Seq:    w.task.outputSeq.Add(1),
+				Offset: w.offset,
+				Data:   append([]byte(nil), data[:n]...),
+				Time:   time.Now(),
+			})
+		}
+		w.offset += int64(n)
+		data = data[n:]
+	}
+	return len(p), nil
+}
+
+func (w *outputWriter) String() string {
+	return w.buf.String()
+}
+
+// sendOutput 沿任务所在的流发送输出块。输出块不需要确认，完整输出仍随最终结果发送
+func (c *Client) sendOutput(req *Message, chunk OutputChunk) {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		log.Printf("Failed to marshal output of task %s: %s", chunk.TaskID, err)
+		return
+	}
+	err = c.SendMsg(&Message{
+		ID:     uuid.New().String(),
+		Type:   msgTypeTaskOutput,
+		Data:   data,
+		stream: req.stream,
+	})
+	if err != nil {
+		log.Printf("Failed to send output of task %s: %s", chunk.TaskID, err)
+	}
+}
+
+// outputHub 按偏移重组 agent 发来的输出块并转发给订阅者。
+// 输出块可能因重连改走其他流而乱序或重复到达。批量任务中同一 TaskID 在多台 agent 上运行，
+// 每台 agent 的输出分别重组，订阅者通过 OutputChunk.MachineID 区分
+type outputHub struct {
+	mu    sync.Mutex
+	tasks map[string]*taskOutput
+}
+
+type taskOutput struct {
+	// refs 为仍在运行的 agent 及批量任务的引用数，降为 0 时关闭订阅者
+	refs        int
+	hosts       map[string]*hostOutput
+	subscribers map[chan OutputChunk]struct{}
+}
+
+// hostOutput 为任务在一台 agent 上的输出的重组状态
+type hostOutput struct {
+	next         map[OutputStream]int64
+	pending      map[OutputStream][]OutputChunk
+	pendingBytes int
+}
+
+func newOutputHub() *outputHub {
+	return &outputHub{tasks: make(map[string]*taskOutput)}
+}
+
+func (h *outputHub) get(taskID string) *taskOutput {
+	t, ok := h.tasks[taskID]
+	if !ok {
+		t = &taskOutput{
+			hosts:       make(map[string]*hostOutput),
+			subscribers: make(map[chan OutputChunk]struct{}),
+		}
+		h.tasks[taskID] = t
+	}
+	return t
+}
+
+// hold 使任务的订阅者在 release 前保持打开，批量任务用它跨越各台 agent 的执行
+func (h *outputHub) hold(taskID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.get(taskID).refs++
+}
+
+func (h *outputHub) release(taskID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releaseLocked(taskID)
+}
+
+func (h *outputHub) releaseLocked(taskID string) {
+	t, ok := h.tasks[taskID]
+	if !ok {
+		return
+	}
+	if t.refs--; t.refs > 0 {
+		return
+	}
+	h.closeLocked(taskID, t)
+}
+
+func (h *outputHub) closeLocked(taskID string, t *taskOutput) {
+	delete(h.tasks, taskID)
+	for ch := range t.subscribers {
+		close(ch)
+	}
+}
+
+// start 开始接收 machineID 上任务 taskID 的输出，未运行该任务的 agent 发来的输出块会被丢弃
+func (h *outputHub) start(taskID, machineID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.get(taskID)
+	if _, ok := t.hosts[machineID]; ok {
+		return
+	}
+	t.refs++
+	t.hosts[machineID] = &hostOutput{
+		next:    make(map[OutputStream]int64),
+		pending: make(map[OutputStream][]OutputChunk),
+	}
+}
+
+func (h *outputHub) subscribe(taskID string, bufferSize int) (<-chan OutputChunk, func()) {
+	ch := make(chan OutputChunk, bufferSize)
+
+	h.mu.Lock()
+	h.get(taskID).subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		t, ok := h.tasks[taskID]
+		if !ok {
+			return
+		}
+		if _, ok := t.subscribers[ch]; ok {
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+		if t.refs == 0 && len(t.subscribers) == 0 {
+			delete(h.tasks, taskID)
+		}
+	}
+}
+
+// finish 在任务在 machineID 上结束后释放其重组状态，所有 agent 都结束后关闭订阅者的 channel
+func (h *outputHub) finish(taskID, machineID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tasks[taskID]
+	if !ok {
+		return
+	}
+	if _, ok := t.hosts[machineID]; ok {
+		delete(t.hosts, machineID)
+		h.releaseLocked(taskID)
+		return
+	}
+	// 未开启 StreamOutput 的任务没有输出，结束时同样关闭订阅者
+	if t.refs == 0 {
+		h.closeLocked(taskID, t)
+	}
+}
+
+// put 接收一个输出块，按偏移顺序转发给订阅者，重复的部分被丢弃，超前的部分缓存到前序块到达
+func (h *outputHub) put(machineID string, chunk OutputChunk) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.tasks[chunk.TaskID]
+	if !ok {
+		return fmt.Errorf("no running task %s", chunk.TaskID)
+	}
+	host, ok := t.hosts[machineID]
+	if !ok {
+		return fmt.Errorf("task %s does not run on %s", chunk.TaskID, machineID)
+	}
+	chunk.MachineID = machineID
+
+	if chunk.Offset > host.next[chunk.Stream] {
+		host.pending[chunk.Stream] = append(host.pending[chunk.Stream], chunk)
+		host.pendingBytes += len(chunk.Data)
+		if host.pendingBytes > maxPendingOutput {
+			for stream := range host.pending {
+				t.skipGap(host, chunk.TaskID, stream)
+			}
+		}
+		return nil
+	}
+	t.emit(host, chunk)
+	t.drain(host, chunk.Stream)
+	return nil
+}
+
+// emit 转发输出块中尚未转发的部分
+func (t *taskOutput) emit(host *hostOutput, chunk OutputChunk) {
+	next := host.next[chunk.Stream]
+	end := chunk.Offset + int64(len(chunk.Data))
+	if end <= next {
+		return
+	}
+	chunk.Data = chunk.Data[next-chunk.Offset:]
+	chunk.Offset = next
+	host.next[chunk.Stream] = end
+
+	for ch := range t.subscribers {
+		select {
+		case ch <- chunk:
+		default:
+			log.Printf("Output subscriber is full, dropping %d bytes of %s for task %s on %s", len(chunk.Data), chunk.Stream, chunk.TaskID, chunk.MachineID)
+		}
+	}
+}
+
+// drain 转发缓存中已可以衔接的输出块
+func (t *taskOutput) drain(host *hostOutput, stream OutputStream) {
+	for {
+		pending := host.pending[stream]
+		i := 0
+		for i < len(pending) && pending[i].Offset > host.next[stream] {
+			i++
+		}
+		if i == len(pending) {
+			return
+		}
+		chunk := pending[i]
+		host.pending[stream] = append(pending[:i], pending[i+1:]...)
+		host.pendingBytes -= len(chunk.Data)
+		t.emit(host, chunk)
+	}
+}
+
+// skipGap 放弃等待缺失的输出，从缓存中最早的偏移继续转发
+func (t *taskOutput) skipGap(host *hostOutput, taskID string, stream OutputStream) {
+	pending := host.pending[stream]
+	if len(pending) == 0 {
+		return
+	}
+	first := pending[0].Offset
+	for _, chunk := range pending[1:] {
+		if chunk.Offset < first {
+			first = chunk.Offset
+		}
+	}
+	log.Printf("Skipping %d bytes of missing %s for task %s", first-host.next[stream], stream, taskID)
+	host.next[stream] = first
+	t.drain(host, stream)
+}
+
+// HandleTaskOutput 接收 agent 发来的实时输出并转发给订阅者
+func (s *Server) HandleTaskOutput(msg *Message, client *Client) error {
+	var chunk OutputChunk
+	if err := json.Unmarshal(msg.Data, &chunk); err != nil {
+		return fmt.Errorf("failed to unmarshal task output: %w", err)
+	}
+	return s.output.put(client.MachineID, chunk)
+}
+
+// SubscribeOutput 订阅任务的实时输出，每台 agent 的每路输出按偏移顺序收到，任务结束后 channel 被关闭。
+// 需在 Dispatch 或 RunBatch 前使用指定的 TaskID 订阅才能收到完整输出，批量任务的 channel 在整个批次结束后关闭；
+// 订阅者处理不及时时输出块会被丢弃，完整输出仍可从任务结果中获得。调用返回的函数取消订阅
+func (s *Server) SubscribeOutput(taskID string, bufferSize int) (<-chan OutputChunk, func()) {
+	return s.output.subscribe(taskID, bufferSize)
+}
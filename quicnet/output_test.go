@@ -0,0 +1,107 @@
+package quicnet
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutputHubReassemble(t *testing.T) {
+	h := newOutputHub()
+	ch, cancel := h.subscribe("t1", 16)
+	defer cancel()
+	h.start("t1", "m1")
+
+	chunk := func(stream OutputStream, offset int64, data string) OutputChunk {
+		return OutputChunk{TaskID: "t1", Stream: stream, Offset: offset, Data: []byte(data)}
+	}
+	if err := h.put("m2", chunk(OutputStdout, 0, "abc")); err == nil {
+		t.Errorf("Expected output from another agent to be rejected, but it was accepted")
+	}
+	for _, c := range []OutputChunk{
+		chunk(OutputStdout, 3, "def"),
+		chunk(OutputStderr, 0, "err"),
+		chunk(OutputStdout, 0, "abc"),
+		chunk(OutputStdout, 0, "abc"),
+		chunk(OutputStdout, 6, "g"),
+	} {
+		if err := h.put("m1", c); err != nil {
+			t.Fatalf("Failed to put output chunk: %s", err)
+		}
+	}
+	h.finish("t1", "m1")
+
+	got := map[OutputStream]string{}
+	for c := range ch {
+		got[c.Stream] += string(c.Data)
+	}
+	if got[OutputStdout] != "abcdefg" || got[OutputStderr] != "err" {
+		t.Errorf("Expected stdout %q and stderr %q, but got %q", "abcdefg", "err", got)
+	}
+	if err := h.put("m1", chunk(OutputStdout, 7, "h")); err == nil {
+		t.Errorf("Expected output of finished task to be rejected, but it was accepted")
+	}
+}
+
+func TestOutputHubHosts(t *testing.T) {
+	h := newOutputHub()
+	ch, cancel := h.subscribe("batch", 16)
+	defer cancel()
+	h.hold("batch")
+	h.start("batch", "m1")
+	h.start("batch", "m2")
+
+	for _, machineID := range []string{"m1", "m2"} {
+		chunk := OutputChunk{TaskID: "batch", Stream: OutputStdout, Data: []byte(machineID)}
+		if err := h.put(machineID, chunk); err != nil {
+			t.Errorf("Expected output from %s to be accepted, but got %s", machineID, err)
+		}
+	}
+	// 一台 agent 结束不影响其他 agent 的输出和订阅者
+	h.finish("batch", "m1")
+	if err := h.put("m1", OutputChunk{TaskID: "batch", Stream: OutputStdout, Offset: 2, Data: []byte("x")}); err == nil {
+		t.Errorf("Expected output from a finished agent to be rejected, but it was accepted")
+	}
+	h.finish("batch", "m2")
+	h.start("batch", "m3")
+	h.put("m3", OutputChunk{TaskID: "batch", Stream: OutputStdout, Data: []byte("m3")})
+	h.finish("batch", "m3")
+	h.release("batch")
+
+	outputs := map[string]string{}
+	for c := range ch {
+		outputs[c.MachineID] += string(c.Data)
+	}
+	if len(outputs) != 3 || outputs["m1"] != "m1" || outputs["m2"] != "m2" || outputs["m3"] != "m3" {
+		t.Errorf("Expected output from m1, m2 and m3, but got %q", outputs)
+	}
+}
+
+func TestRunBatchStreamOutput(t *testing.T) {
+	s := newTestServer(t)
+	hosts := []string{"output-agent-1", "output-agent-2"}
+	for _, machineID := range hosts {
+		newTestClient(t, s, withMachineID(machineID))
+	}
+	ch, cancel := s.SubscribeOutput("stream-batch", 64)
+	defer cancel()
+
+	// 批次超时后订阅者同样会被关闭，下面的循环不会一直阻塞
+	ctx, cancelBatch := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelBatch()
+	req := &ScriptTaskRequest{TaskID: "stream-batch", Content: "echo start; sleep 0.2; echo end", StreamOutput: true}
+	b := s.RunBatch(ctx, hosts, req, BatchOptions{})
+	outputs := map[string]string{}
+	for c := range ch {
+		outputs[c.MachineID] += string(c.Data)
+	}
+	<-b.Done()
+	for _, machineID := range hosts {
+		if outputs[machineID] != "start\nend\n" {
+			t.Errorf("Expected streamed output of %s, but got %q", machineID, outputs[machineID])
+		}
+	}
+	if summary := b.Summary(); len(summary.Succeeded) != 2 {
+		t.Errorf("Expected both hosts to succeed, but got %+v", summary)
+	}
+}
@@ -0,0 +1,295 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type PrincipalKind string
+
+const (
+	PrincipalOperator PrincipalKind = "operator"
+	PrincipalAgent    PrincipalKind = "agent"
+)
+
+// Principal 为已认证的调用方：使用令牌的运维人员或持有证书的 agent
+type Principal struct {
+	Kind PrincipalKind `json:"kind"`
+	Name string        `json:"name"`
+}
+
+func (p Principal) String() string {
+	return string(p.Kind) + ":" + p.Name
+}
+
+// interpreterDefault 表示请求未指定解释器，由 agent 使用其平台的默认解释器
+const interpreterDefault = "default"
+
+var ErrInvalidOperatorToken = errors.New("invalid operator token")
+
+// Grant 描述主体可以执行的操作
+type Grant struct {
+	// MessageTypes 为允许发送的消息类型，"*" 表示全部
+	MessageTypes []string
+	// Targets 为允许作为目标的 agent 的选择器表达式，为空表示不限
+	Targets string
+	// Interpreters 为 ScriptTaskRequest 允许使用的解释器，为空表示不限，
+	// 未指定解释器的请求按 "default" 检查
+	Interpreters []string
+}
+
+// DefaultAgentGrant 为未单独配置的 agent 的权限：心跳、入网、证书续期和上报任务输出
+var DefaultAgentGrant = Grant{
+	MessageTypes: []string{"heartbeat", msgTypeEnroll, msgTypeCertRenew, msgTypeTaskOutput},
+}
+
+type compiledGrant struct {
+	Grant
+	targets *Selector
+}
+
+func compileGrant(g Grant) (*compiledGrant, error) {
+	cg := &compiledGrant{Grant: g}
+	if g.Targets != "" {
+		selector, err := ParseSelector(g.Targets)
+		if err != nil {
+			return nil, err
+		}
+		cg.targets = selector
+	}
+	return cg, nil
+}
+
+// PermissionError 为授权检查拒绝请求时返回的错误
+type PermissionError struct {
+	Principal   Principal
+	MessageType string
+	Target      string
+	Reason      string
+}
+
+func (e *PermissionError) Error() string {
+	if e.Target != "" {
+		return fmt.Sprintf("%s may not send %s to %s: %s", e.Principal, e.MessageType, e.Target, e.Reason)
+	}
+	return fmt.Sprintf("%s may not send %s: %s", e.Principal, e.MessageType, e.Reason)
+}
+
+// Policy 决定主体可以发送哪些消息、以哪些 agent 为目标以及使用哪些解释器
+type Policy struct {
+	mu        sync.RWMutex
+	operators map[string]string
+	grants    map[Principal]*compiledGrant
+	agents    *compiledGrant
+}
+
+func NewPolicy() *Policy {
+	agents, _ := compileGrant(DefaultAgentGrant)
+	return &Policy{
+		operators: make(map[string]string),
+		grants:    make(map[Principal]*compiledGrant),
+		agents:    agents,
+	}
+}
+
+// AddOperator 添加使用 token 认证的运维人员，同名运维人员的令牌和权限会被替换
+func (p *Policy) AddOperator(name, token string, grant Grant) error {
+	if name == "" || token == "" {
+		return errors.New("operator name and token are required")
+	}
+	cg, err := compileGrant(grant)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for hash, n := range p.operators {
+		if n == name {
+			delete(p.operators, hash)
+		}
+	}
+	p.operators[hashSecret(token)] = name
+	p.grants[Principal{Kind: PrincipalOperator, Name: name}] = cg
+	return nil
+}
+
+func (p *Policy) RemoveOperator(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for hash, n := range p.operators {
+		if n == name {
+			delete(p.operators, hash)
+		}
+	}
+	delete(p.grants, Principal{Kind: PrincipalOperator, Name: name})
+}
+
+// SetAgentGrant 设置 agent 的权限，machineID 为空时设置所有未单独配置的 agent 的默认权限
+func (p *Policy) SetAgentGrant(machineID string, grant Grant) error {
+	cg, err := compileGrant(grant)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if machineID == "" {
+		p.agents = cg
+	} else {
+		p.grants[Principal{Kind: PrincipalAgent, Name: machineID}] = cg
+	}
+	return nil
+}
+
+// Authenticate 返回 token 对应的运维人员
+func (p *Policy) Authenticate(token string) (Principal, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	name, ok := p.operators[hashSecret(token)]
+	if !ok {
+		return Principal{}, ErrInvalidOperatorToken
+	}
+	return Principal{Kind: PrincipalOperator, Name: name}, nil
+}
+
+func (p *Policy) grant(principal Principal) *compiledGrant {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if g, ok := p.grants[principal]; ok {
+		return g
+	}
+	if principal.Kind == PrincipalAgent {
+		return p.agents
+	}
+	return nil
+}
+
+// Authorize 检查 principal 能否向 target 发送 msg，target 为 nil 表示发往服务端。
+// 拒绝时返回 *PermissionError
+func (p *Policy) Authorize(principal Principal, msg *Message, target *Client) error {
+	deny := func(format string, args ...interface{}) error {
+		e := &PermissionError{
+			Principal:   principal,
+			MessageType: msg.Type,
+			Reason:      fmt.Sprintf(format, args...),
+		}
+		if target != nil {
+			e.Target = target.MachineID
+		}
+		return e
+	}
+
+	g := p.grant(principal)
+	if g == nil {
+		return deny("no grant")
+	}
+	if !containsString(g.MessageTypes, msg.Type) && !containsString(g.MessageTypes, "*") {
+		return deny("message type not allowed")
+	}
+	if target != nil && g.targets != nil && !g.targets.Match(target.Attributes()) {
+		return deny("target does not match %q", g.Targets)
+	}
+	if msg.Type == "script_task" && len(g.Interpreters) > 0 {
+		var req ScriptTaskRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return deny("invalid script task request")
+		}
+		interpreter := req.Interpreter
+		if interpreter == "" {
+			interpreter = interpreterDefault
+		}
+		if !containsString(g.Interpreters, interpreter) {
+			return deny("interpreter %q not allowed", interpreter)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal 返回携带 principal 的 ctx，Server 的 Dispatch、Call 和 RunBatch 按其权限检查请求
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext 返回 ctx 中的主体
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// WithPolicy 启用授权检查，agent 发来的请求以及 Dispatch、Call、RunBatch 均需通过 policy，
+// 后者的 ctx 必须通过 WithPrincipal 或 OperatorContext 携带主体
+func WithPolicy(policy *Policy) ServerOption {
+	return func(s *Server) {
+		s.policy = policy
+	}
+}
+
+// OperatorContext 用运维令牌认证，返回携带对应主体的 ctx
+func (s *Server) OperatorContext(ctx context.Context, token string) (context.Context, error) {
+	if s.policy == nil {
+		return nil, errors.New("authorization policy is not enabled")
+	}
+	principal, err := s.policy.Authenticate(token)
+	if err != nil {
+		s.auditLog(AuditEvent{Principal: Principal{Kind: PrincipalOperator}, Action: "authenticate", Reason: err.Error()})
+		return nil, err
+	}
+	return WithPrincipal(ctx, principal), nil
+}
+
+// authorizeOperator 检查 ctx 中的主体能否向 target 发送 msg，启用 Policy 时 ctx 中没有主体的请求被拒绝
+func (s *Server) authorizeOperator(ctx context.Context, msg *Message, target *Client) error {
+	if s.policy == nil {
+		return nil
+	}
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		err := &PermissionError{
+			Principal:   Principal{Kind: PrincipalOperator},
+			MessageType: msg.Type,
+			Target:      target.MachineID,
+			Reason:      "no principal in context",
+		}
+		s.auditLog(AuditEvent{
+			Principal: err.Principal,
+			Action:    msg.Type,
+			Target:    target.MachineID,
+			MessageID: msg.ID,
+			Reason:    err.Reason,
+		})
+		return err
+	}
+	return s.checkPolicy(principal, msg, target)
+}
+
+func (s *Server) checkPolicy(principal Principal, msg *Message, target *Client) error {
+	err := s.policy.Authorize(principal, msg, target)
+	event := AuditEvent{
+		Principal: principal,
+		Action:    msg.Type,
+		MessageID: msg.ID,
+		Allowed:   err == nil,
+	}
+	if target != nil {
+		event.Target = target.MachineID
+	}
+	var permErr *PermissionError
+	if errors.As(err, &permErr) {
+		event.Reason = permErr.Reason
+	}
+	s.auditLog(event)
+	return err
+}
@@ -0,0 +1,101 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	p := NewPolicy()
+	if err := p.AddOperator("alice", "secret", Grant{
+		MessageTypes: []string{"script_task"},
+		Targets:      "env=staging",
+		Interpreters: []string{"default", "bash"},
+	}); err != nil {
+		t.Fatalf("Failed to add operator: %s", err)
+	}
+	alice, err := p.Authenticate("secret")
+	if err != nil || alice.Name != "alice" {
+		t.Fatalf("Expected the token to authenticate alice, but got %v (error: %v)", alice, err)
+	}
+	if _, err := p.Authenticate("wrong"); err != ErrInvalidOperatorToken {
+		t.Errorf("Expected %v for a wrong token, but got %v", ErrInvalidOperatorToken, err)
+	}
+
+	script := func(interpreter string) *Message {
+		data, _ := json.Marshal(&ScriptTaskRequest{Content: "true", Interpreter: interpreter})
+		return &Message{Type: "script_task", Data: data}
+	}
+	staging := &Client{MachineID: "m1", Labels: map[string]string{"env": "staging"}}
+	prod := &Client{MachineID: "m2", Labels: map[string]string{"env": "prod"}}
+
+	tests := []struct {
+		name      string
+		principal Principal
+		msg       *Message
+		target    *Client
+		allowed   bool
+	}{
+		{"default interpreter", alice, script(""), staging, true},
+		{"allowed interpreter", alice, script("bash"), staging, true},
+		{"denied interpreter", alice, script("python3"), staging, false},
+		{"denied target", alice, script(""), prod, false},
+		{"denied type", alice, &Message{Type: "cert_renew"}, staging, false},
+		{"unknown operator", Principal{Kind: PrincipalOperator, Name: "bob"}, script(""), staging, false},
+		{"agent heartbeat", Principal{Kind: PrincipalAgent, Name: "m1"}, &Message{Type: "heartbeat"}, nil, true},
+		{"agent script", Principal{Kind: PrincipalAgent, Name: "m1"}, script(""), nil, false},
+	}
+	for _, tt := range tests {
+		err := p.Authorize(tt.principal, tt.msg, tt.target)
+		var permErr *PermissionError
+		if tt.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, but got %v", tt.name, err)
+		}
+		if !tt.allowed && !errors.As(err, &permErr) {
+			t.Errorf("Expected %s to be denied with *PermissionError, but got %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthorizeReplies(t *testing.T) {
+	s := &Server{policy: NewPolicy(), tasks: newPendingTasks()}
+	s.tasks.add(newTaskFuture("m1", "task-msg", "task"))
+	client := &Client{MachineID: "m1"}
+
+	if err := s.authorize(client, &Message{Type: "script_task", ReplyTo: "task-msg"}); err != nil {
+		t.Errorf("Expected the result of a pending task to be allowed, but got %v", err)
+	}
+	// 不对应待完成任务的回复与请求一样检查授权
+	var permErr *PermissionError
+	if err := s.authorize(client, &Message{Type: "script_task", ReplyTo: "unknown"}); !errors.As(err, &permErr) {
+		t.Errorf("Expected an unsolicited reply to be denied, but got %v", err)
+	}
+	if err := s.authorize(&Client{MachineID: "m2"}, &Message{Type: "script_task", ReplyTo: "task-msg"}); !errors.As(err, &permErr) {
+		t.Errorf("Expected a reply to another agent's task to be denied, but got %v", err)
+	}
+}
+
+func TestAuthorizeOperatorWithoutPrincipal(t *testing.T) {
+	p := NewPolicy()
+	if err := p.AddOperator("alice", "secret", Grant{MessageTypes: []string{"*"}}); err != nil {
+		t.Fatalf("Failed to add operator: %s", err)
+	}
+	var events []AuditEvent
+	s := &Server{policy: p, audit: func(e AuditEvent) { events = append(events, e) }}
+	msg := &Message{Type: "script_task"}
+	target := &Client{MachineID: "m1"}
+
+	var permErr *PermissionError
+	if err := s.authorizeOperator(context.Background(), msg, target); !errors.As(err, &permErr) {
+		t.Errorf("Expected a request without principal to be denied, but got %v", err)
+	}
+	ctx := WithPrincipal(context.Background(), Principal{Kind: PrincipalOperator, Name: "alice"})
+	if err := s.authorizeOperator(ctx, msg, target); err != nil {
+		t.Errorf("Expected alice to be allowed, but got %v", err)
+	}
+	if len(events) != 2 || events[0].Allowed || !events[1].Allowed {
+		t.Errorf("Expected a denied and an allowed audit event, but got %+v", events)
+	}
+}
@@ -0,0 +1,245 @@
+package quicnet
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 60 * time.Second
+	defaultMaxOffline        = 10000
+)
+
+type PresenceState string
+
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceStale   PresenceState = "stale"
+	PresenceOffline PresenceState = "offline"
+)
+
+type PresenceEventType string
+
+const (
+	EventConnect    PresenceEventType = "connect"
+	EventDisconnect PresenceEventType = "disconnect"
+	EventStale      PresenceEventType = "stale"
+	EventRecover    PresenceEventType = "recover"
+	EventEvict      PresenceEventType = "evict"
+)
+
+type PresenceEvent struct {
+	Type      PresenceEventType
+	MachineID string
+	Hostname  string
+	Time      time.Time
+}
+
+type PresenceConfig struct {
+	// HeartbeatInterval 为 agent 的心跳间隔，默认 60 秒
+	HeartbeatInterval time.Duration
+	// StaleAfter 为多久未收到心跳标记为 stale，默认两个心跳间隔
+	StaleAfter time.Duration
+	// OfflineAfter 为多久未收到心跳断开连接并标记为 offline，默认四个心跳间隔
+	OfflineAfter time.Duration
+	// EvictAfter 为 offline 状态保留多久后移除，默认 24 小时
+	EvictAfter time.Duration
+	// MaxOffline 为最多保留的 offline 记录数，超过时先移除断开最早的，默认 10000
+	MaxOffline int
+}
+
+func (pc PresenceConfig) withDefaults() PresenceConfig {
+	if pc.HeartbeatInterval <= 0 {
+		pc.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if pc.StaleAfter <= 0 {
+		pc.StaleAfter = 2 * pc.HeartbeatInterval
+	}
+	if pc.OfflineAfter <= 0 {
+		pc.OfflineAfter = 4 * pc.HeartbeatInterval
+	}
+	if pc.EvictAfter <= 0 {
+		pc.EvictAfter = 24 * time.Hour
+	}
+	if pc.MaxOffline <= 0 {
+		pc.MaxOffline = defaultMaxOffline
+	}
+	return pc
+}
+
+type PresenceInfo struct {
+	MachineID      string
+	Hostname       string
+	IP             string
+	State          PresenceState
+	ConnectedAt    time.Time
+	LastSeen       time.Time
+	DisconnectedAt time.Time
+}
+
+// presence 记录在 Client 上，由 ClientManager 的锁保护
+type presence struct {
+	state          PresenceState
+	connectedAt    time.Time
+	lastSeen       time.Time
+	disconnectedAt time.Time
+}
+
+func (cm *ClientManager) SetPresenceConfig(config PresenceConfig) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.presenceCfg = config.withDefaults()
+}
+
+// Subscribe 订阅 agent 上下线事件，订阅者处理不及时时事件会被丢弃；调用返回的函数取消订阅
+func (cm *ClientManager) Subscribe(bufferSize int) (<-chan PresenceEvent, func()) {
+	ch := make(chan PresenceEvent, bufferSize)
+
+	cm.subMu.Lock()
+	cm.subscribers[ch] = struct{}{}
+	cm.subMu.Unlock()
+
+	return ch, func() {
+		cm.subMu.Lock()
+		defer cm.subMu.Unlock()
+		if _, ok := cm.subscribers[ch]; ok {
+			delete(cm.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (cm *ClientManager) emit(eventType PresenceEventType, client *Client) {
+	event := PresenceEvent{
+		Type:      eventType,
+		MachineID: client.MachineID,
+		Hostname:  client.Hostname,
+		Time:      time.Now(),
+	}
+
+	cm.subMu.Lock()
+	defer cm.subMu.Unlock()
+	for ch := range cm.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("Presence subscriber is full, dropping %s event for %s", event.Type, event.MachineID)
+		}
+	}
+}
+
+func (cm *ClientManager) presenceInfo(client *Client) PresenceInfo {
+	return PresenceInfo{
+		MachineID:      client.MachineID,
+		Hostname:       client.Hostname,
+		IP:             client.IP,
+		State:          client.presence.state,
+		ConnectedAt:    client.presence.connectedAt,
+		LastSeen:       client.presence.lastSeen,
+		DisconnectedAt: client.presence.disconnectedAt,
+	}
+}
+
+func (cm *ClientManager) Presence(machineID string) (PresenceInfo, bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	client, ok := cm.clients[machineID]
+	if !ok {
+		return PresenceInfo{}, false
+	}
+	return cm.presenceInfo(client), true
+}
+
+func (cm *ClientManager) ListPresence() []PresenceInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	infos := make([]PresenceInfo, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		infos = append(infos, cm.presenceInfo(client))
+	}
+	return infos
+}
+
+// Disconnect 在连接断开时将 agent 标记为 offline，记录保留到被 sweeper 移除
+func (cm *ClientManager) Disconnect(client *Client) bool {
+	cm.mu.Lock()
+	if client.MachineID == "" || cm.clients[client.MachineID] != client || client.presence.state == PresenceOffline {
+		cm.mu.Unlock()
+		return false
+	}
+	client.presence.state = PresenceOffline
+	client.presence.disconnectedAt = time.Now()
+	cm.mu.Unlock()
+
+	cm.emit(EventDisconnect, client)
+	return true
+}
+
+// StartSweeper 定期根据最后心跳时间更新 agent 状态：超时未心跳的标记为 stale，
+// 更久未心跳的断开连接，offline 超过 EvictAfter 或超出 MaxOffline 的移除。调用返回的函数停止 sweeper
+func (cm *ClientManager) StartSweeper(interval time.Duration) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cm.sweep(time.Now())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func (cm *ClientManager) sweep(now time.Time) {
+	var stale, silent, offline, evicted []*Client
+
+	cm.mu.Lock()
+	cfg := cm.presenceCfg
+	for machineID, client := range cm.clients {
+		p := &client.presence
+		switch {
+		case p.state == PresenceOffline:
+			if now.Sub(p.disconnectedAt) > cfg.EvictAfter {
+				delete(cm.clients, machineID)
+				evicted = append(evicted, client)
+			} else {
+				offline = append(offline, client)
+			}
+		case now.Sub(p.lastSeen) > cfg.OfflineAfter:
+			silent = append(silent, client)
+		case p.state == PresenceOnline && now.Sub(p.lastSeen) > cfg.StaleAfter:
+			p.state = PresenceStale
+			stale = append(stale, client)
+		}
+	}
+	if n := len(offline) - cfg.MaxOffline; n > 0 {
+		sort.Slice(offline, func(i, j int) bool {
+			return offline[i].presence.disconnectedAt.Before(offline[j].presence.disconnectedAt)
+		})
+		for _, client := range offline[:n] {
+			delete(cm.clients, client.MachineID)
+			evicted = append(evicted, client)
+		}
+	}
+	cm.mu.Unlock()
+
+	for _, client := range stale {
+		cm.emit(EventStale, client)
+	}
+	for _, client := range silent {
+		log.Printf("Client %s has been silent for too long, closing connection", client.MachineID)
+		client.Close()
+		cm.Disconnect(client)
+	}
+	for _, client := range evicted {
+		cm.emit(EventEvict, client)
+		if cm.onEvict != nil {
+			cm.onEvict(client)
+		}
+	}
+}
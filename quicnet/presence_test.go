@@ -0,0 +1,113 @@
+package quicnet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newPresenceClient(cm *ClientManager, machineID string) *Client {
+	client := &Client{done: make(chan struct{})}
+	cm.Register(client, &HeartbeatData{MachineID: machineID, Hostname: machineID})
+	return client
+}
+
+func expectPresenceEvent(t *testing.T, events <-chan PresenceEvent, eventType PresenceEventType, machineID string) {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType || event.MachineID != machineID {
+			t.Errorf("Expected %s event for %s, but got %s for %s", eventType, machineID, event.Type, event.MachineID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected %s event for %s, but got none", eventType, machineID)
+	}
+}
+
+func expectPresenceState(t *testing.T, cm *ClientManager, machineID string, state PresenceState) {
+	t.Helper()
+	info, ok := cm.Presence(machineID)
+	if !ok || info.State != state {
+		t.Errorf("Expected %s to be %s, but got %+v (found: %v)", machineID, state, info, ok)
+	}
+}
+
+func TestPresenceLifecycle(t *testing.T) {
+	cm := NewClientManager()
+	cm.SetPresenceConfig(PresenceConfig{HeartbeatInterval: time.Second, EvictAfter: 10 * time.Second})
+	events, unsubscribe := cm.Subscribe(10)
+
+	client := newPresenceClient(cm, "m1")
+	expectPresenceEvent(t, events, EventConnect, "m1")
+	expectPresenceState(t, cm, "m1", PresenceOnline)
+
+	// 超过两个心跳间隔未心跳标记为 stale，再次心跳后恢复
+	cm.sweep(time.Now().Add(3 * time.Second))
+	expectPresenceEvent(t, events, EventStale, "m1")
+	expectPresenceState(t, cm, "m1", PresenceStale)
+	cm.Register(client, &HeartbeatData{MachineID: "m1", Hostname: "m1"})
+	expectPresenceEvent(t, events, EventRecover, "m1")
+	expectPresenceState(t, cm, "m1", PresenceOnline)
+
+	if !cm.Disconnect(client) {
+		t.Errorf("Expected first disconnect to be reported")
+	}
+	if cm.Disconnect(client) {
+		t.Errorf("Expected repeated disconnect not to be reported")
+	}
+	expectPresenceEvent(t, events, EventDisconnect, "m1")
+	expectPresenceState(t, cm, "m1", PresenceOffline)
+
+	// offline 记录在 EvictAfter 之前保留
+	cm.sweep(time.Now().Add(5 * time.Second))
+	expectPresenceState(t, cm, "m1", PresenceOffline)
+	cm.sweep(time.Now().Add(11 * time.Second))
+	expectPresenceEvent(t, events, EventEvict, "m1")
+	if _, ok := cm.Presence("m1"); ok {
+		t.Errorf("Expected m1 to be evicted")
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Errorf("Expected events channel to be closed after unsubscribe")
+	}
+}
+
+func TestPresenceMaxOffline(t *testing.T) {
+	cm := NewClientManager()
+	cm.SetPresenceConfig(PresenceConfig{MaxOffline: 2})
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		machineID := fmt.Sprintf("m%d", i)
+		client := newPresenceClient(cm, machineID)
+		cm.Disconnect(client)
+		cm.mu.Lock()
+		client.presence.disconnectedAt = now.Add(time.Duration(i) * time.Minute)
+		cm.mu.Unlock()
+	}
+	newPresenceClient(cm, "online")
+
+	cm.sweep(now.Add(3 * time.Minute))
+	if _, ok := cm.Presence("m0"); ok {
+		t.Errorf("Expected the earliest disconnected agent to be evicted")
+	}
+	for _, machineID := range []string{"m1", "m2"} {
+		expectPresenceState(t, cm, machineID, PresenceOffline)
+	}
+	if _, ok := cm.Presence("online"); !ok {
+		t.Errorf("Expected connected agents not to count towards MaxOffline")
+	}
+}
+
+func TestPresenceSilentAgent(t *testing.T) {
+	s := newTestServer(t)
+	events, unsubscribe := s.ClientManager().Subscribe(10)
+	defer unsubscribe()
+	c := newTestClient(t, s)
+	expectPresenceEvent(t, events, EventConnect, c.MachineID)
+
+	// 超过四个心跳间隔未心跳时服务端断开连接
+	s.ClientManager().sweep(time.Now().Add(5 * defaultHeartbeatInterval))
+	expectPresenceEvent(t, events, EventDisconnect, c.MachineID)
+}
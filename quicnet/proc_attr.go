@@ -0,0 +1,74 @@
+package quicnet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ResourceLimits 为脚本进程的资源限制，0 表示沿用 agent 的限制。
+// 限制只能设置在 agent 自身的硬限制以内
+type ResourceLimits struct {
+	CPUSeconds uint64 `json:"cpu_seconds,omitempty"`
+	OpenFiles  uint64 `json:"open_files,omitempty"`
+	// AddressSpace 为虚拟内存的字节数
+	AddressSpace uint64 `json:"address_space,omitempty"`
+	// FileSize 为脚本可以写入的单个文件的最大字节数
+	FileSize uint64 `json:"file_size,omitempty"`
+}
+
+// scriptError 为无法按请求的方式启动脚本的原因，code 随脚本结果返回给服务端
+type scriptError struct {
+	code ScriptErrorCode
+	msg  string
+}
+
+func (e *scriptError) Error() string {
+	return e.msg
+}
+
+func newScriptError(code ScriptErrorCode, format string, args ...interface{}) *scriptError {
+	return &scriptError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// fail 记录脚本未能启动的原因，err 不是 scriptError 时使用 code
+func (r *ScriptResult) fail(err error, code ScriptErrorCode) {
+	r.Error = err.Error()
+	r.Code = code
+	var se *scriptError
+	if errors.As(err, &se) {
+		r.Code = se.code
+	}
+}
+
+// parseUmask 解析八进制的 umask，例如 "022"
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, newScriptError(CodeInvalidOptions, "invalid umask %q", s)
+	}
+	return int(mask), nil
+}
+
+func checkWorkDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return newScriptError(CodeInvalidWorkDir, "work dir %s: %s", dir, err)
+	}
+	if !info.IsDir() {
+		return newScriptError(CodeInvalidWorkDir, "work dir %s is not a directory", dir)
+	}
+	return nil
+}
+
+// startErrorCode 返回启动脚本失败时的错误码，切换用户或进入工作目录被拒绝时为 PERMISSION_DENIED
+func startErrorCode(err error) ScriptErrorCode {
+	if errors.Is(err, os.ErrPermission) {
+		return CodePermissionDenied
+	}
+	return CodeStartFailed
+}
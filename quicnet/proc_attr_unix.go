@@ -0,0 +1,177 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package quicnet
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prepareCommand 按任务设置运行脚本的用户、用户组、工作目录、umask、优先级和资源限制。
+// umask、优先级和资源限制由 sh 在切换用户后、执行解释器前设置
+func prepareCommand(cmd *exec.Cmd, task *ScriptTask, scriptPath string) error {
+	if err := checkWorkDir(task.Dir); err != nil {
+		return err
+	}
+	cmd.Dir = task.Dir
+
+	cred, u, err := credential(task.User, task.Group)
+	if err != nil {
+		return err
+	}
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		// 临时脚本由 agent 创建，需交给运行脚本的用户
+		if err := os.Chown(scriptPath, int(cred.Uid), int(cred.Gid)); err != nil {
+			return newScriptError(CodePermissionDenied, "chown script to %d:%d: %s", cred.Uid, cred.Gid, err)
+		}
+	}
+	if u != nil {
+		cmd.Env = append(os.Environ(), "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	}
+
+	// nice 由切换用户后的 sh 执行，提高优先级需要脚本本身以 root 运行
+	if task.Nice < 0 && (os.Geteuid() != 0 || cred != nil && cred.Uid != 0) {
+		return newScriptError(CodePermissionDenied, "nice %d requires the script to run as root", task.Nice)
+	}
+
+	var prelude []string
+	if task.Umask != "" {
+		mask, err := parseUmask(task.Umask)
+		if err != nil {
+			return err
+		}
+		prelude = append(prelude, fmt.Sprintf("umask %03o", mask))
+	}
+	limits, err := ulimitCommands(task.Limits)
+	if err != nil {
+		return err
+	}
+	prelude = append(prelude, limits...)
+	// 在 exec 前设置优先级，脚本及其创建的子进程都使用该优先级
+	run := `exec "$@"`
+	if task.Nice != 0 {
+		run = fmt.Sprintf(`exec nice -n %d "$@"`, task.Nice)
+	}
+	if len(prelude) > 0 || task.Nice != 0 {
+		prelude = append(prelude, run)
+		cmd.Args = append([]string{"sh", "-c", strings.Join(prelude, " && "), "sh"}, cmd.Args...)
+		cmd.Path = "/bin/sh"
+	}
+	return nil
+}
+
+// setProcessGroup 使脚本在新的会话和进程组中运行，停止时可以向整个进程组发送信号
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+}
+
+// signalGroup 向进程组发送 SIGTERM，force 为 true 时发送 SIGKILL
+func signalGroup(pid int, force bool) error {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-pid, sig)
+}
+
+// credential 解析运行脚本的用户和用户组，与 agent 相同时返回 nil；
+// 只指定用户时使用该用户的主组和附加组
+func credential(userName, groupName string) (*syscall.Credential, *user.User, error) {
+	if userName == "" && groupName == "" {
+		return nil, nil, nil
+	}
+	uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+	var groups []uint32
+	var u *user.User
+	if userName != "" {
+		var err error
+		if u, err = lookupUser(userName); err != nil {
+			return nil, nil, newScriptError(CodeUserNotFound, "user %s: %s", userName, err)
+		}
+		uid = parseID(u.Uid)
+		gid = parseID(u.Gid)
+		ids, err := u.GroupIds()
+		if err == nil {
+			for _, id := range ids {
+				groups = append(groups, parseID(id))
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return nil, nil, newScriptError(CodeGroupNotFound, "group %s: %s", groupName, err)
+		}
+		gid = parseID(g.Gid)
+	}
+	if uid == uint32(os.Geteuid()) && gid == uint32(os.Getegid()) {
+		return nil, u, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, nil, newScriptError(CodePermissionDenied, "agent runs as uid %d and cannot run scripts as %d:%d", os.Geteuid(), uid, gid)
+	}
+	return &syscall.Credential{Uid: uid, Gid: gid, Groups: groups}, u, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+func parseID(id string) uint32 {
+	n, _ := strconv.ParseUint(id, 10, 32)
+	return uint32(n)
+}
+
+// ulimitCommands 生成设置资源限制的 ulimit 命令，超过 agent 硬限制的请求会被拒绝。
+// sh 的 ulimit -v 以 KiB 为单位，-f 以 512 字节为单位
+func ulimitCommands(limits *ResourceLimits) ([]string, error) {
+	if limits == nil {
+		return nil, nil
+	}
+	var cmds []string
+	for _, l := range []struct {
+		resource int
+		name     string
+		flag     string
+		value    uint64
+		unit     uint64
+	}{
+		{syscall.RLIMIT_CPU, "cpu seconds", "-t", limits.CPUSeconds, 1},
+		{syscall.RLIMIT_NOFILE, "open files", "-n", limits.OpenFiles, 1},
+		{syscall.RLIMIT_AS, "address space", "-v", limits.AddressSpace, 1024},
+		{syscall.RLIMIT_FSIZE, "file size", "-f", limits.FileSize, 512},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		var current syscall.Rlimit
+		if err := syscall.Getrlimit(l.resource, &current); err != nil {
+			return nil, newScriptError(CodeInvalidOptions, "get %s limit: %s", l.name, err)
+		}
+		if uint64(current.Max) < l.value {
+			return nil, newScriptError(CodePermissionDenied, "%s limit %d exceeds the agent's hard limit %d", l.name, l.value, current.Max)
+		}
+		cmds = append(cmds, fmt.Sprintf("ulimit %s %d", l.flag, (l.value+l.unit-1)/l.unit))
+	}
+	return cmds, nil
+}
@@ -0,0 +1,91 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package quicnet
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunScriptProcAttr(t *testing.T) {
+	dir := t.TempDir()
+	task := &ScriptTask{
+		TaskID:       "attr",
+		Content:      "pwd; umask; ulimit -n",
+		Timeout:      5 * time.Second,
+		Dir:          dir,
+		Umask:        "027",
+		Limits:       &ResourceLimits{OpenFiles: 64},
+		ScriptResult: &ScriptResult{},
+	}
+	NewCmdRunner().RunScript(task)
+	if task.ScriptResult.Code != CodeSuccess {
+		t.Fatalf("Expected success, but got %s: %s", task.ScriptResult.Code, task.ScriptResult.Error)
+	}
+	lines := strings.Fields(task.ScriptResult.Stdout)
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], strings.TrimPrefix(dir, "/private")) || lines[1] != "0027" || lines[2] != "64" {
+		t.Fatalf("Expected the work dir, umask 0027 and 64 open files, but got %q", task.ScriptResult.Stdout)
+	}
+
+	for _, tc := range []struct {
+		task *ScriptTask
+		code ScriptErrorCode
+	}{
+		{&ScriptTask{User: "no-such-user-lops"}, CodeUserNotFound},
+		{&ScriptTask{Dir: dir + "/missing"}, CodeInvalidWorkDir},
+		{&ScriptTask{Umask: "999"}, CodeInvalidOptions},
+		{&ScriptTask{Limits: &ResourceLimits{OpenFiles: 1 << 40}}, CodePermissionDenied},
+	} {
+		tc.task.Content = "true"
+		tc.task.Timeout = 5 * time.Second
+		tc.task.ScriptResult = &ScriptResult{}
+		NewCmdRunner().RunScript(tc.task)
+		if tc.task.ScriptResult.Code != tc.code {
+			t.Errorf("Expected %s, but got %s: %s", tc.code, tc.task.ScriptResult.Code, tc.task.ScriptResult.Error)
+		}
+	}
+
+	runAs := &ScriptTask{User: "nobody", Content: "id -un", Timeout: 5 * time.Second, ScriptResult: &ScriptResult{}}
+	NewCmdRunner().RunScript(runAs)
+	if os.Geteuid() != 0 {
+		if runAs.ScriptResult.Code != CodePermissionDenied {
+			t.Errorf("Expected %s, but got %s", CodePermissionDenied, runAs.ScriptResult.Code)
+		}
+	} else if runAs.ScriptResult.Stdout != "nobody\n" {
+		t.Errorf("Expected the script to run as nobody, but got %q: %s", runAs.ScriptResult.Stdout, runAs.ScriptResult.Error)
+	}
+}
+
+func TestRunScriptNice(t *testing.T) {
+	// 输出脚本和其子进程的优先级
+	niceness := func(nice int) []string {
+		task := &ScriptTask{
+			TaskID:       "nice",
+			Content:      "ps -o nice= -p $$; sh -c 'ps -o nice= -p $$'",
+			Timeout:      5 * time.Second,
+			Nice:         nice,
+			ScriptResult: &ScriptResult{},
+		}
+		NewCmdRunner().RunScript(task)
+		if task.ScriptResult.Code != CodeSuccess {
+			t.Fatalf("Expected success, but got %s: %s", task.ScriptResult.Code, task.ScriptResult.Error)
+		}
+		return strings.Fields(task.ScriptResult.Stdout)
+	}
+	base := niceness(0)
+	if len(base) != 2 {
+		t.Fatalf("Expected two niceness values, but got %v", base)
+	}
+	agentNice, _ := strconv.Atoi(base[0])
+	if agentNice+5 > 19 {
+		t.Skipf("agent already runs at nice %d", agentNice)
+	}
+	want := strconv.Itoa(agentNice + 5)
+	if got := niceness(5); len(got) != 2 || got[0] != want || got[1] != want {
+		t.Errorf("Expected the script and its children to run at nice %s, but got %v", want, got)
+	}
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+package quicnet
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// prepareCommand 在 Windows 上只支持设置工作目录
+func prepareCommand(cmd *exec.Cmd, task *ScriptTask, scriptPath string) error {
+	if task.User != "" || task.Group != "" || task.Umask != "" || task.Nice != 0 || task.Limits != nil {
+		return newScriptError(CodeUnsupported, "run-as user, umask, nice and resource limits are not supported on windows")
+	}
+	if err := checkWorkDir(task.Dir); err != nil {
+		return err
+	}
+	cmd.Dir = task.Dir
+	return nil
+}
+
+// setProcessGroup 使脚本在新的进程组中运行
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// signalGroup 在 Windows 上没有 SIGTERM，直接结束脚本进程
+func signalGroup(pid int, force bool) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func groupAlive(pid int) bool {
+	return false
+}
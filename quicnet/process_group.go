@@ -0,0 +1,94 @@
+package quicnet
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultGracePeriod 为停止脚本时从 SIGTERM 到 SIGKILL 的默认等待时间
+	defaultGracePeriod = 5 * time.Second
+	groupPollInterval  = 50 * time.Millisecond
+)
+
+// processGroup 为脚本进程所在的进程组。停止时先向整个进程组发送 SIGTERM，
+// 宽限期内仍未退出则发送 SIGKILL；脚本退出后残留的后台进程按同样的方式清理
+type processGroup struct {
+	grace time.Duration
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newProcessGroup(grace time.Duration) *processGroup {
+	if grace <= 0 {
+		grace = defaultGracePeriod
+	}
+	return &processGroup{grace: grace, done: make(chan struct{})}
+}
+
+// terminate 开始停止以 pid 为组长的进程组，重复调用没有影响
+func (g *processGroup) terminate(pid int) {
+	g.once.Do(func() {
+		go g.escalate(pid)
+	})
+}
+
+func (g *processGroup) escalate(pid int) {
+	defer close(g.done)
+	if err := signalGroup(pid, false); err != nil {
+		return
+	}
+	deadline := time.Now().Add(g.grace)
+	for time.Now().Before(deadline) {
+		if !groupAlive(pid) {
+			return
+		}
+		time.Sleep(groupPollInterval)
+	}
+	log.Printf("Process group %d did not exit within %s, killing it", pid, g.grace)
+	signalGroup(pid, true)
+}
+
+// wait 等待 terminate 发出的停止过程结束
+func (g *processGroup) wait() {
+	<-g.done
+}
+
+// outputPipe 将脚本的一路输出复制到 w。使用 *os.File 作为子进程的输出，
+// Wait 不必等待仍持有管道的后台进程
+type outputPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+func newOutputPipe(w io.Writer) (*outputPipe, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &outputPipe{r: r, w: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		io.Copy(w, r)
+	}()
+	return p, nil
+}
+
+// closeWriter 关闭本进程持有的写端，子进程启动后调用
+func (p *outputPipe) closeWriter() {
+	p.w.Close()
+}
+
+// wait 等待管道的写端全部关闭，超过 timeout 时放弃读取剩余的输出
+func (p *outputPipe) wait(timeout time.Duration) {
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("Script output is still held open after %s, closing it", timeout)
+	}
+	p.r.Close()
+	<-p.done
+}
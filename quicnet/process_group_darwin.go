@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package quicnet
+
+import "syscall"
+
+// groupAlive 判断进程组中是否还有进程
+func groupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package quicnet
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// groupAlive 判断进程组中是否还有未退出的进程。后台进程退出后由 init 回收，
+// 回收前仍是进程组的成员，因此需要从 /proc 中排除僵尸进程
+func groupAlive(pgid int) bool {
+	if syscall.Kill(-pgid, 0) != nil {
+		return false
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return true
+	}
+	group := strconv.Itoa(pgid)
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// 进程名可能包含空格和括号，从最后一个 ')' 之后依次为 state ppid pgrp
+		i := bytes.LastIndexByte(data, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) >= 3 && fields[2] == group && fields[0] != "Z" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package quicnet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunScriptProcessGroup(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		grace   time.Duration
+		code    ScriptErrorCode
+		stdout  string
+	}{
+		// 残留的后台进程不再阻塞脚本结束
+		{"background", "sleep 30 &\necho started", time.Second, CodeSuccess, "started\n"},
+		// 超时后整个进程组先收到 SIGTERM
+		{"graceful", "trap 'echo term; exit 0' TERM\nsleep 30 &\nwait", 0, CodeTimeout, "term\n"},
+		// 忽略 SIGTERM 的进程在宽限期后被 SIGKILL
+		{"kill", "trap '' TERM\nsleep 30", 500 * time.Millisecond, CodeTimeout, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			task := &ScriptTask{
+				TaskID:       tc.name,
+				Content:      tc.content,
+				Timeout:      500 * time.Millisecond,
+				GracePeriod:  tc.grace,
+				ScriptResult: &ScriptResult{},
+			}
+			start := time.Now()
+			NewCmdRunner().RunScript(task)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("Expected the script to finish within 3s, but it took %s", elapsed)
+			}
+			if task.ScriptResult.Code != tc.code {
+				t.Fatalf("Expected %s, but got %s: %s", tc.code, task.ScriptResult.Code, task.ScriptResult.Error)
+			}
+			if !strings.Contains(task.ScriptResult.Stdout, tc.stdout) {
+				t.Fatalf("Expected stdout to contain %q, but got %q", tc.stdout, task.ScriptResult.Stdout)
+			}
+		})
+	}
+}
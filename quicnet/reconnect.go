@@ -0,0 +1,269 @@
+package quicnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+var ErrNotConnected = errors.New("not connected")
+
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateDisconnected
+	StateReconnecting
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+// ConnStateFunc 在连接状态变化时被调用，addr 为当前（或刚断开的）服务端地址
+type ConnStateFunc func(state ConnState, addr string, err error)
+
+// Backoff 为重连的指数退避参数，Jitter 为随机抖动比例（0.2 表示 ±20%），为 0 时不抖动。
+// Initial、Max、Multiplier 为 0 时使用 DefaultBackoff 中的值，Multiplier 必须大于 1
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = DefaultBackoff.Multiplier
+	}
+	return b
+}
+
+func (b Backoff) validate() error {
+	if b.Multiplier <= 1 {
+		return fmt.Errorf("invalid backoff multiplier %v: must be greater than 1", b.Multiplier)
+	}
+	if b.Jitter < 0 || b.Jitter >= 1 {
+		return fmt.Errorf("invalid backoff jitter %v: must be in [0, 1)", b.Jitter)
+	}
+	return nil
+}
+
+// Duration 返回第 attempt 次重试前的等待时间，抖动后同样不超过 Max
+func (b Backoff) Duration(attempt int) time.Duration {
+	b = b.withDefaults()
+	if b.Multiplier <= 1 {
+		b.Multiplier = DefaultBackoff.Multiplier
+	}
+	d := float64(b.Initial)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// WithServerAddrs 设置备用服务端地址，连接断开后按顺序轮流尝试
+func WithServerAddrs(addrs ...string) ClientOption {
+	return func(c *Client) {
+		c.serverAddrs = append(c.serverAddrs, addrs...)
+	}
+}
+
+// WithBackoff 设置重连的退避参数，未设置的字段使用 DefaultBackoff 中的值
+func WithBackoff(backoff Backoff) ClientOption {
+	return func(c *Client) {
+		c.backoff = backoff.withDefaults()
+	}
+}
+
+func WithConnStateFunc(fn ConnStateFunc) ClientOption {
+	return func(c *Client) {
+		c.connStateFunc = fn
+	}
+}
+
+func (c *Client) setConnState(state ConnState, addr string, err error) {
+	c.connMu.Lock()
+	c.connState = state
+	c.connMu.Unlock()
+	if c.connStateFunc != nil {
+		c.connStateFunc(state, addr, err)
+	}
+}
+
+func (c *Client) ConnState() ConnState {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.connState
+}
+
+// connectAny 依次尝试所有服务端地址，直到有一个连接成功
+func (c *Client) connectAny() error {
+	var err error
+	for range c.serverAddrs {
+		if err = c.Reconnect(); err == nil {
+			c.setConnState(StateConnected, c.currentAddr(), nil)
+			return nil
+		}
+		log.Printf("Failed to connect: %s", err)
+	}
+	return err
+}
+
+// Reconnect 连接下一个服务端地址，成功后替换当前连接
+func (c *Client) Reconnect() error {
+	c.connMu.Lock()
+	addr := c.serverAddrs[c.nextAddr%len(c.serverAddrs)]
+	c.nextAddr++
+	c.connMu.Unlock()
+
+	session, err := quic.DialAddr(addr, c.tlsCfg, c.quicCfg)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", addr, err)
+	}
+
+	stream, err := session.OpenStreamSync(context.Background())
+	if err != nil {
+		session.CloseWithError(0, "")
+		return fmt.Errorf("open stream to %s: %w", addr, err)
+	}
+	codecs := c.codecs
+	if len(codecs) == 0 {
+		codecs = codecNames()
+	}
+	peer, err := clientHello(stream, localHello(c.messageHandler, codecs, c.maxFrameSize, c.compression))
+	if err != nil {
+		session.CloseWithError(CloseIncompatible, "")
+		return fmt.Errorf("hello with %s: %w", addr, err)
+	}
+
+	c.connMu.Lock()
+	// Close 已关闭旧连接，新连接不会再被关闭
+	if c.IsClosed() {
+		c.connMu.Unlock()
+		session.CloseWithError(CloseNormal, "")
+		return ErrClientClosed
+	}
+	c.session = session
+	c.stream = stream
+	c.peer = peer
+	go c.acceptStreams(session)
+	c.serverAddr = addr
+	c.connState = StateConnected
+	if udpAddr := getLocalIP(session); udpAddr != nil {
+		c.IP = udpAddr.IP.String()
+	}
+	c.connMu.Unlock()
+	return nil
+}
+
+// reconnectLoop 以指数退避不断重连，直到成功或客户端被关闭
+func (c *Client) reconnectLoop(cause error) bool {
+	c.connMu.Lock()
+	addr := c.serverAddr
+	c.connState = StateDisconnected
+	if c.session != nil {
+		var tooLarge *FrameTooLargeError
+		if errors.As(cause, &tooLarge) {
+			c.session.CloseWithError(CloseFrameTooLarge, tooLarge.Error())
+		} else {
+			c.session.CloseWithError(0, "")
+		}
+	}
+	c.connMu.Unlock()
+
+	log.Printf("Disconnected from %s: %s", addr, describeConnError(cause))
+	c.setConnState(StateDisconnected, addr, cause)
+
+	for attempt := 0; ; attempt++ {
+		delay := c.backoff.Duration(attempt)
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return false
+		}
+
+		c.setConnState(StateReconnecting, "", nil)
+		err := c.Reconnect()
+		if c.IsClosed() {
+			return false
+		}
+		if err == nil {
+			c.setConnState(StateConnected, c.currentAddr(), nil)
+			// 重新注册，然后补发断线期间未确认的消息
+			c.sendHeartbeat()
+			c.flushSpool()
+			return true
+		}
+		log.Printf("Failed to reconnect (attempt %d): %s", attempt+1, err)
+	}
+}
+
+func (c *Client) currentAddr() string {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.serverAddr
+}
+
+func describeConnError(err error) string {
+	var (
+		idleErr      *quic.IdleTimeoutError
+		appErr       *quic.ApplicationError
+		resetErr     *quic.StatelessResetError
+		transportErr *quic.TransportError
+	)
+	switch {
+	case errors.Is(err, io.EOF):
+		return "stream closed by server"
+	case errors.As(err, &idleErr):
+		return "idle timeout"
+	case errors.As(err, &appErr):
+		return fmt.Sprintf("closed by server (code %d): %s", appErr.ErrorCode, appErr.ErrorMessage)
+	case errors.As(err, &resetErr):
+		return "stateless reset"
+	case errors.As(err, &transportErr):
+		return fmt.Sprintf("transport error: %s", transportErr)
+	default:
+		return err.Error()
+	}
+}
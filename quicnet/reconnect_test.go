@@ -0,0 +1,124 @@
+package quicnet
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if d := b.Duration(tt.attempt); d != tt.expected {
+			t.Errorf("Expected attempt %d to wait %s, but got %s", tt.attempt, tt.expected, d)
+		}
+	}
+
+	b.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if d := b.Duration(1); d < 1600*time.Millisecond || d > 2400*time.Millisecond {
+			t.Fatalf("Expected jittered delay within 20%% of 2s, but got %s", d)
+		}
+	}
+	// 抖动后同样不超过 Max
+	for i := 0; i < 100; i++ {
+		if d := b.Duration(100); d > b.Max {
+			t.Fatalf("Expected jittered delay of at most %s, but got %s", b.Max, d)
+		}
+	}
+
+	// 未设置的字段使用 DefaultBackoff
+	if d := (Backoff{}).Duration(1); d != 2*DefaultBackoff.Initial {
+		t.Errorf("Expected the default backoff to wait %s, but got %s", 2*DefaultBackoff.Initial, d)
+	}
+}
+
+func TestBackoffValidate(t *testing.T) {
+	for _, b := range []Backoff{{Multiplier: 1}, {Multiplier: 0.5}, {Multiplier: -2}, {Jitter: 1.5}} {
+		if _, err := NewClient("127.0.0.1:1", testClientTLS(), nil, WithBackoff(b)); err == nil {
+			t.Errorf("Expected backoff %+v to be rejected", b)
+		}
+	}
+	if err := (Backoff{Multiplier: 1.5}).withDefaults().validate(); err != nil {
+		t.Errorf("Expected a multiplier of 1.5 to be valid, but got %s", err)
+	}
+}
+
+type connStateRecorder struct {
+	mu     sync.Mutex
+	states []ConnState
+}
+
+func (r *connStateRecorder) record(state ConnState, addr string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *connStateRecorder) snapshot() []ConnState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ConnState(nil), r.states...)
+}
+
+func (r *connStateRecorder) count(state ConnState) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.states {
+		if s == state {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReconnect(t *testing.T) {
+	s := newTestServer(t)
+	addr := testServerAddr(s)
+	recorder := &connStateRecorder{}
+	c := newTestClient(t, s,
+		WithBackoff(Backoff{Initial: 20 * time.Millisecond, Max: 100 * time.Millisecond, Multiplier: 2}),
+		WithConnStateFunc(recorder.record))
+	if n := recorder.count(StateConnected); n != 1 {
+		t.Errorf("Expected the initial connect to be reported once, but got %d", n)
+	}
+
+	s.Close()
+	eventually(t, 3*time.Second, func() bool { return recorder.count(StateDisconnected) == 1 })
+
+	s = startTestServer(t, addr)
+	eventually(t, 5*time.Second, func() bool { return s.ClientManager().GetClient(c.MachineID) != nil })
+	if c.ConnState() != StateConnected || recorder.count(StateConnected) != 2 {
+		t.Errorf("Expected the client to report reconnecting, but got states %v", recorder.snapshot())
+	}
+	if recorder.count(StateReconnecting) == 0 {
+		t.Errorf("Expected reconnect attempts to be reported, but got states %v", recorder.snapshot())
+	}
+}
+
+func TestReconnectAfterClose(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	c.Close()
+
+	if err := c.Reconnect(); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Expected reconnect after close to fail with %v, but got %v", ErrClientClosed, err)
+	}
+	// 新建立的连接已被关闭，服务端不会再收到该 agent 的心跳
+	eventually(t, 3*time.Second, func() bool {
+		client := s.ClientManager().GetClient(c.MachineID)
+		return client == nil || client.IsClosed()
+	})
+}
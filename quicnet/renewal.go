@@ -0,0 +1,218 @@
+package quicnet
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	msgTypeCertRenew = "cert_renew"
+
+	certRenewTimeout    = 30 * time.Second
+	certRenewRetryDelay = time.Minute
+)
+
+type CertRenewRequest struct {
+	CSR string `json:"csr"`
+}
+
+// certRenewer 持有 agent 当前的客户端证书，新证书通过 GetClientCertificate 用于之后的握手
+type certRenewer struct {
+	dir         string
+	renewBefore time.Duration
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// WithCertRenewal 使用 Enroll 保存在 dir 中的证书，并在证书到期前通过现有连接续期。
+// renewBefore 为到期前多久续期，0 表示在剩余有效期不足三分之一时续期
+func WithCertRenewal(dir string, renewBefore time.Duration) ClientOption {
+	return func(c *Client) {
+		c.renewer = &certRenewer{dir: dir, renewBefore: renewBefore}
+	}
+}
+
+func (r *certRenewer) load() error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(r.dir, ClientCertFile), filepath.Join(r.dir, ClientKeyFile))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certRenewer) current() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *certRenewer) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// renewAt 返回证书应当续期的时间
+func (r *certRenewer) renewAt() time.Time {
+	leaf := r.current().Leaf
+	if r.renewBefore > 0 {
+		return leaf.NotAfter.Add(-r.renewBefore)
+	}
+	return leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+}
+
+// tlsConfig 返回使用续期证书的 TLS 配置，base 为空时使用 dir 中的 CA 证书校验服务端
+func (r *certRenewer) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if base == nil {
+		pool, err := loadCertPool(filepath.Join(r.dir, ClientCAFile))
+		if err != nil {
+			return nil, err
+		}
+		base = &tls.Config{RootCAs: pool, NextProtos: []string{NextProto}, MinVersion: tls.VersionTLS13}
+	}
+	cfg := base.Clone()
+	cfg.Certificates = nil
+	cfg.GetClientCertificate = r.getClientCertificate
+	return cfg, nil
+}
+
+func (c *Client) renewLoop() {
+	for {
+		wait := time.Until(c.renewer.renewAt())
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.done:
+				timer.Stop()
+				return
+			}
+		}
+		if err := c.RenewCertificate(); err != nil {
+			log.Printf("Failed to renew client certificate: %s", err)
+			select {
+			case <-time.After(certRenewRetryDelay):
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// RenewCertificate 用当前私钥向服务端申请新证书，成功后保存到磁盘，之后的重连使用新证书
+func (c *Client) RenewCertificate() error {
+	if c.renewer == nil {
+		return errors.New("certificate renewal is not enabled")
+	}
+	cur := c.renewer.current()
+	key, ok := cur.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported client private key")
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: cur.Leaf.Subject,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), certRenewTimeout)
+	defer cancel()
+	reply, err := c.Call(ctx, msgTypeCertRenew, CertRenewRequest{
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+	})
+	if err != nil {
+		return err
+	}
+	var resp EnrollResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return err
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair([]byte(resp.Certificate), keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid renewed certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(c.renewer.dir, ClientCertFile), []byte(resp.Certificate), 0644); err != nil {
+		return err
+	}
+	if resp.CACertificate != "" {
+		if err := writeFileAtomic(filepath.Join(c.renewer.dir, ClientCAFile), []byte(resp.CACertificate), 0644); err != nil {
+			return err
+		}
+	}
+	c.renewer.mu.Lock()
+	c.renewer.cert = &cert
+	c.renewer.mu.Unlock()
+	log.Printf("Renewed client certificate, valid until %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// HandleCertRenew 为已认证的 agent 续签证书，新证书必须使用与当前证书相同的公钥
+func (s *Server) HandleCertRenew(msg *Message, client *Client) error {
+	if msg.IsReply() {
+		return nil
+	}
+	if s.ca == nil {
+		return NewRemoteError(ErrCodeBadRequest, "certificate renewal is not enabled")
+	}
+	identity := client.Identity
+	if identity == nil {
+		return NewRemoteError(ErrCodeUnauthenticated, "client certificate required")
+	}
+	if s.revoked(identity) {
+		return NewRemoteError(ErrCodeUnauthenticated, "%s", ErrCertificateRevoked)
+	}
+	var req CertRenewRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return NewRemoteError(ErrCodeBadRequest, "invalid renew request: %s", err)
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return NewRemoteError(ErrCodeBadRequest, "invalid csr")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return NewRemoteError(ErrCodeBadRequest, "invalid csr: %s", err)
+	}
+	if publicKeyFingerprint(csr.RawSubjectPublicKeyInfo) != identity.PublicKeyFingerprint {
+		return NewRemoteError(ErrCodeBadRequest, "csr public key does not match the current certificate")
+	}
+	cert, err := s.ca.SignClientCSR(csr, identity.MachineID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Renewed certificate of %s", identity.MachineID)
+	return client.Reply(msg, EnrollResponse{
+		Certificate:   string(cert),
+		CACertificate: string(s.ca.CertificatePEM()),
+	})
+}
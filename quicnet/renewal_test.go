@@ -0,0 +1,106 @@
+package quicnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startEnrolledServer 启动由 ca 签发证书的服务端，并将一个 agent 入网到 dir 中
+func startEnrolledServer(t *testing.T, ca *CA, dir string, opts ...ServerOption) *Server {
+	t.Helper()
+	ts, err := OpenTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Failed to open token store: %s", err)
+	}
+	token, _, _ := ts.Create(TokenOptions{})
+	tlsCfg, err := ca.ServerTLSConfig("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Failed to create server tls config: %s", err)
+	}
+	s, err := NewServer("127.0.0.1:0", tlsCfg, nil, append(opts, WithEnrollment(ca, ts))...)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	go s.Start()
+	t.Cleanup(s.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = Enroll(ctx, EnrollConfig{ServerAddr: testServerAddr(s), Token: token, Dir: dir, CAFingerprint: ca.Fingerprint()})
+	if err != nil {
+		t.Fatalf("Failed to enroll: %s", err)
+	}
+	return s
+}
+
+func TestRenewAt(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &certRenewer{cert: &tls.Certificate{Leaf: &x509.Certificate{
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(90 * time.Hour),
+	}}}
+	// 默认在剩余有效期不足三分之一时续期
+	if at := r.renewAt(); !at.Equal(notBefore.Add(60 * time.Hour)) {
+		t.Errorf("Expected renewal after 60h, but got %s", at.Sub(notBefore))
+	}
+	r.renewBefore = 24 * time.Hour
+	if at := r.renewAt(); !at.Equal(notBefore.Add(66 * time.Hour)) {
+		t.Errorf("Expected renewal after 66h, but got %s", at.Sub(notBefore))
+	}
+}
+
+func TestRenewCertificate(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create CA: %s", err)
+	}
+	dir := t.TempDir()
+	s := startEnrolledServer(t, ca, dir)
+
+	c, err := NewClient(testServerAddr(s), nil, nil, WithCertRenewal(dir, 0),
+		WithBackoff(Backoff{Initial: 20 * time.Millisecond, Max: 100 * time.Millisecond, Multiplier: 2}))
+	if err != nil {
+		t.Fatalf("Failed to connect with enrolled certificate: %s", err)
+	}
+	defer c.Close()
+	old := c.renewer.current()
+	oldPEM, _ := os.ReadFile(filepath.Join(dir, ClientCertFile))
+
+	if err := c.RenewCertificate(); err != nil {
+		t.Fatalf("Expected renewal to succeed, but got %s", err)
+	}
+	cur := c.renewer.current()
+	if cur.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) == 0 {
+		t.Errorf("Expected a new certificate, but got serial %s again", old.Leaf.SerialNumber)
+	}
+	if !bytes.Equal(cur.Leaf.RawSubjectPublicKeyInfo, old.Leaf.RawSubjectPublicKeyInfo) {
+		t.Errorf("Expected the renewed certificate to keep the private key")
+	}
+	if id, _ := MachineIDFromCertificate(cur.Leaf); id != c.MachineID {
+		t.Errorf("Expected the renewed certificate for %s, but got %s", c.MachineID, id)
+	}
+	if newPEM, _ := os.ReadFile(filepath.Join(dir, ClientCertFile)); bytes.Equal(newPEM, oldPEM) {
+		t.Errorf("Expected the renewed certificate to be saved")
+	}
+
+	// 之后的重连使用续期后的证书
+	eventually(t, 3*time.Second, func() bool { return s.ClientManager().GetClient(c.MachineID) != nil })
+	s.ClientManager().GetClient(c.MachineID).CloseWithError(CloseNormal, "")
+	eventually(t, 3*time.Second, func() bool {
+		client := s.ClientManager().GetClient(c.MachineID)
+		return client != nil && !client.IsClosed() && client.Identity.SerialNumber == cur.Leaf.SerialNumber.Text(16)
+	})
+}
+
+func TestRenewCertificateDisabled(t *testing.T) {
+	c := newDeliveryClient()
+	if err := c.RenewCertificate(); err == nil {
+		t.Errorf("Expected renewal without WithCertRenewal to fail")
+	}
+}
@@ -0,0 +1,171 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// Revocation 为一条吊销记录，按证书序列号或 MachineID 吊销，二者只填其一
+type Revocation struct {
+	SerialNumber string    `json:"serial_number,omitempty"`
+	MachineID    string    `json:"machine_id,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
+
+// RevocationList 为服务端的证书吊销列表，保存在 JSON 文件中，path 为空时只保存在内存中
+type RevocationList struct {
+	mu       sync.RWMutex
+	path     string
+	serials  map[string]Revocation
+	machines map[string]Revocation
+	onRevoke []func()
+}
+
+func OpenRevocationList(path string) (*RevocationList, error) {
+	rl := &RevocationList{
+		path:     path,
+		serials:  make(map[string]Revocation),
+		machines: make(map[string]Revocation),
+	}
+	if path == "" {
+		return rl, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Revocation
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.SerialNumber != "" {
+			rl.serials[e.SerialNumber] = e
+		} else {
+			rl.machines[e.MachineID] = e
+		}
+	}
+	return rl, nil
+}
+
+// RevokeSerial 吊销指定序列号（十六进制，可含冒号）的证书
+func (rl *RevocationList) RevokeSerial(serial string, reason string) error {
+	n, ok := new(big.Int).SetString(strings.ReplaceAll(serial, ":", ""), 16)
+	if !ok {
+		return fmt.Errorf("invalid serial number %q", serial)
+	}
+	return rl.add(Revocation{SerialNumber: n.Text(16), Reason: reason, RevokedAt: time.Now()})
+}
+
+// RevokeMachine 吊销 machineID 的所有证书
+func (rl *RevocationList) RevokeMachine(machineID string, reason string) error {
+	if machineID == "" {
+		return errors.New("empty machine id")
+	}
+	return rl.add(Revocation{MachineID: machineID, Reason: reason, RevokedAt: time.Now()})
+}
+
+func (rl *RevocationList) add(e Revocation) error {
+	rl.mu.Lock()
+	if e.SerialNumber != "" {
+		rl.serials[e.SerialNumber] = e
+	} else {
+		rl.machines[e.MachineID] = e
+	}
+	err := rl.save()
+	hooks := rl.onRevoke
+	rl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, fn := range hooks {
+		fn()
+	}
+	return nil
+}
+
+// List 按吊销时间返回所有吊销记录
+func (rl *RevocationList) List() []Revocation {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.entries()
+}
+
+func (rl *RevocationList) entries() []Revocation {
+	entries := make([]Revocation, 0, len(rl.serials)+len(rl.machines))
+	for _, e := range rl.serials {
+		entries = append(entries, e)
+	}
+	for _, e := range rl.machines {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RevokedAt.Before(entries[j].RevokedAt)
+	})
+	return entries
+}
+
+// IsRevoked 判断序列号为 serial 的证书或 machineID 是否已被吊销
+func (rl *RevocationList) IsRevoked(serial *big.Int, machineID string) bool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	if serial != nil {
+		if _, ok := rl.serials[serial.Text(16)]; ok {
+			return true
+		}
+	}
+	_, ok := rl.machines[machineID]
+	return ok
+}
+
+func (rl *RevocationList) subscribe(fn func()) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.onRevoke = append(rl.onRevoke, fn)
+}
+
+func (rl *RevocationList) save() error {
+	if rl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(rl.entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rl.path, data, 0600)
+}
+
+// WithRevocationList 在每次握手时检查客户端证书是否已被吊销，吊销时立即断开已连接的 agent
+func WithRevocationList(rl *RevocationList) ServerOption {
+	return func(s *Server) {
+		s.crl = rl
+		rl.subscribe(s.disconnectRevoked)
+	}
+}
+
+func (s *Server) revoked(identity *PeerIdentity) bool {
+	return s.crl != nil && identity != nil && s.crl.IsRevoked(identity.Certificate.SerialNumber, identity.MachineID)
+}
+
+func (s *Server) disconnectRevoked() {
+	for _, client := range s.cm.ListClients() {
+		if s.revoked(client.Identity) {
+			log.Printf("Disconnecting %s: certificate %s revoked", client.Identity.MachineID, client.Identity.SerialNumber)
+			client.CloseWithError(CloseRevoked, "certificate revoked")
+		}
+	}
+}
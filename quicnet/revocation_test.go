@@ -0,0 +1,94 @@
+package quicnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocationList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crl.json")
+	rl, err := OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("Failed to open revocation list: %s", err)
+	}
+	revoked := 0
+	rl.subscribe(func() { revoked++ })
+	if err := rl.RevokeSerial("0A:FF", "key compromise"); err != nil {
+		t.Fatalf("Failed to revoke serial: %s", err)
+	}
+	if err := rl.RevokeMachine("m1", "decommissioned"); err != nil {
+		t.Fatalf("Failed to revoke machine: %s", err)
+	}
+	if err := rl.RevokeSerial("xyz", ""); err == nil {
+		t.Errorf("Expected an invalid serial to be refused")
+	}
+	if revoked != 2 {
+		t.Errorf("Expected 2 revoke notifications, but got %d", revoked)
+	}
+
+	rl, err = OpenRevocationList(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen revocation list: %s", err)
+	}
+	tests := []struct {
+		serial    int64
+		machineID string
+		expected  bool
+	}{
+		{0xaff, "m2", true},
+		{1, "m1", true},
+		{1, "m2", false},
+	}
+	for _, tt := range tests {
+		if revoked := rl.IsRevoked(big.NewInt(tt.serial), tt.machineID); revoked != tt.expected {
+			t.Errorf("Expected IsRevoked(%x, %s) to be %v, but got %v", tt.serial, tt.machineID, tt.expected, revoked)
+		}
+	}
+	if n := len(rl.List()); n != 2 {
+		t.Errorf("Expected 2 entries, but got %d", n)
+	}
+}
+
+// TestRevokedAtAccept 检查握手时未被拒绝的已吊销证书在接受连接时被拒绝
+func TestRevokedAtAccept(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create CA: %s", err)
+	}
+	dir := t.TempDir()
+	startEnrolledServer(t, ca, dir)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, ClientCertFile), filepath.Join(dir, ClientKeyFile))
+	if err != nil {
+		t.Fatalf("Failed to load client certificate: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	machineID, _ := MachineIDFromCertificate(leaf)
+
+	rl, _ := OpenRevocationList("")
+	rl.RevokeMachine(machineID, "test")
+	tlsCfg, _ := ca.ServerTLSConfig("127.0.0.1")
+	s, err := NewServer("127.0.0.1:0", tlsCfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	// 不通过 WithRevocationList 设置，握手时不检查吊销列表
+	s.crl = rl
+	go s.Start()
+	defer s.Close()
+	events, unsubscribe := s.ClientManager().Subscribe(10)
+	defer unsubscribe()
+
+	c, err := NewClient(testServerAddr(s), nil, nil, WithCertRenewal(dir, 0))
+	if err == nil {
+		defer c.Close()
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected revoked agent not to register, but got %s for %s", event.Type, event.MachineID)
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,268 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const msgTypeCancel = "cancel"
+
+type ErrorCode string
+
+const (
+	ErrCodeNoHandler        ErrorCode = "NO_HANDLER"
+	ErrCodeBadRequest       ErrorCode = "BAD_REQUEST"
+	ErrCodeInternal         ErrorCode = "INTERNAL"
+	ErrCodeCanceled         ErrorCode = "CANCELED"
+	ErrCodeDeadlineExceeded ErrorCode = "DEADLINE_EXCEEDED"
+	ErrCodeUnauthenticated  ErrorCode = "UNAUTHENTICATED"
+	ErrCodePermissionDenied ErrorCode = "PERMISSION_DENIED"
+	ErrCodeNotFound         ErrorCode = "NOT_FOUND"
+	ErrCodeQueueFull        ErrorCode = "QUEUE_FULL"
+	ErrCodeFrameTooLarge    ErrorCode = "FRAME_TOO_LARGE"
+)
+
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %s: %s", e.Code, e.Message)
+}
+
+func NewRemoteError(code ErrorCode, format string, args ...interface{}) *RemoteError {
+	return &RemoteError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type cancelData struct {
+	ID string `json:"id"`
+}
+
+// rpcState 记录本端发出、等待回复的调用以及对端发来、正在处理的请求
+type rpcState struct {
+	mu       sync.Mutex
+	calls    map[string]chan *Message
+	inflight map[string]context.CancelFunc
+}
+
+func newRPCState() *rpcState {
+	return &rpcState{
+		calls:    make(map[string]chan *Message),
+		inflight: make(map[string]context.CancelFunc),
+	}
+}
+
+func (r *rpcState) addCall(id string) chan *Message {
+	ch := make(chan *Message, 1)
+	r.mu.Lock()
+	r.calls[id] = ch
+	r.mu.Unlock()
+	return ch
+}
+
+func (r *rpcState) removeCall(id string) {
+	r.mu.Lock()
+	delete(r.calls, id)
+	r.mu.Unlock()
+}
+
+func (r *rpcState) resolve(reply *Message) bool {
+	r.mu.Lock()
+	ch, ok := r.calls[reply.ReplyTo]
+	delete(r.calls, reply.ReplyTo)
+	r.mu.Unlock()
+	if ok {
+		ch <- reply
+	}
+	return ok
+}
+
+func (r *rpcState) begin(msg *Message) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := msg.deadline(); ok {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	msg.ctx = ctx
+
+	r.mu.Lock()
+	r.inflight[msg.ID] = cancel
+	r.mu.Unlock()
+}
+
+func (r *rpcState) finish(id string) {
+	r.mu.Lock()
+	cancel, ok := r.inflight[id]
+	delete(r.inflight, id)
+	r.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (r *rpcState) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, cancel := range r.inflight {
+		cancel()
+		delete(r.inflight, id)
+	}
+}
+
+// Call 发送请求并等待对端回复，ctx 的截止时间随消息一起发送，
+// ctx 取消时会通知对端放弃处理
+func (c *Client) Call(ctx context.Context, messageType string, payload interface{}) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(ctx, &Message{
+		ID:   uuid.New().String(),
+		Type: messageType,
+		Data: data,
+	})
+}
+
+func (c *Client) call(ctx context.Context, msg *Message) (*Message, error) {
+	msg.WantReply = true
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Deadline = deadline.UnixMilli()
+	}
+
+	ch := c.rpc.addCall(msg.ID)
+	if err := c.SendMsg(msg); err != nil {
+		c.rpc.removeCall(msg.ID)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, reply.Err()
+	case <-ctx.Done():
+		c.rpc.removeCall(msg.ID)
+		c.sendCancel(msg.ID)
+		return nil, ctx.Err()
+	case <-c.done:
+		c.rpc.removeCall(msg.ID)
+		return nil, ErrClientDisconnected
+	}
+}
+
+func (c *Client) sendCancel(id string) {
+	data, err := json.Marshal(cancelData{ID: id})
+	if err != nil {
+		return
+	}
+	c.SendMsg(&Message{
+		ID:   uuid.New().String(),
+		Type: msgTypeCancel,
+		Data: data,
+	})
+}
+
+// Reply 回复对端的请求
+func (c *Client) Reply(req *Message, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	reply := &Message{
+		ID:      uuid.New().String(),
+		Type:    req.Type,
+		Data:    data,
+		ReplyTo: req.ID,
+		stream:  req.stream,
+	}
+	c.rememberReply(reply)
+	return c.SendReliable(reply)
+}
+
+// ReplyError 以错误回复对端的请求，err 为 *RemoteError 时使用其错误码
+func (c *Client) ReplyError(req *Message, err error) error {
+	code := ErrCodeInternal
+	var remoteErr *RemoteError
+	var permErr *PermissionError
+	switch {
+	case errors.As(err, &remoteErr):
+		code = remoteErr.Code
+		err = errors.New(remoteErr.Message)
+	case errors.As(err, &permErr):
+		code = ErrCodePermissionDenied
+	case errors.Is(err, context.Canceled):
+		code = ErrCodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = ErrCodeDeadlineExceeded
+	}
+	reply := &Message{
+		ID:      uuid.New().String(),
+		Type:    req.Type,
+		ReplyTo: req.ID,
+		Code:    code,
+		Error:   err.Error(),
+		stream:  req.stream,
+	}
+	c.rememberReply(reply)
+	return c.SendReliable(reply)
+}
+
+// handleIncoming 处理回复和取消等 RPC 控制消息，返回 true 表示消息已被消费，
+// 否则为请求建立上下文后交给 MessageHandler
+func (c *Client) handleIncoming(msg *Message) bool {
+	if msg.Type == msgTypeCancel {
+		var cd cancelData
+		if err := json.Unmarshal(msg.Data, &cd); err != nil {
+			log.Printf("Failed to unmarshal cancel message: %s", err)
+			return true
+		}
+		c.rpc.finish(cd.ID)
+		return true
+	}
+	if msg.Type == msgTypeAck {
+		c.handleAck(msg)
+		return true
+	}
+	if msg.IsReply() {
+		if c.rpc.resolve(msg) {
+			c.sendAck(msg)
+			return true
+		}
+		return false
+	}
+	if c.isDuplicate(msg) {
+		return true
+	}
+	// 请求在收到时即确认，处理结果由回复（及磁盘队列）保证送达
+	c.sendAck(msg)
+	c.rpc.begin(msg)
+	return false
+}
+
+// Call 向指定 agent 发送请求并等待回复
+func (s *Server) Call(ctx context.Context, machineID string, messageType string, payload interface{}) (*Message, error) {
+	client, err := s.connectedClient(machineID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		ID:   uuid.New().String(),
+		Type: messageType,
+		Data: data,
+	}
+	if err := s.authorizeOperator(ctx, msg, client); err != nil {
+		return nil, err
+	}
+	return client.call(ctx, msg)
+}
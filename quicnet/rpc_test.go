@@ -0,0 +1,173 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type echoRequest struct {
+	Text string `json:"text"`
+}
+
+func TestCallRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterHandler("echo", func(msg *Message, client *Client) error {
+		var req echoRequest
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return NewRemoteError(ErrCodeBadRequest, "%s", err)
+		}
+		return client.Reply(msg, req)
+	})
+	c := newTestClient(t, s)
+
+	reply, err := c.Call(context.Background(), "echo", echoRequest{Text: "hello"})
+	if err != nil {
+		t.Fatalf("Failed to call echo: %s", err)
+	}
+	var got echoRequest
+	if err := json.Unmarshal(reply.Data, &got); err != nil {
+		t.Fatalf("Failed to unmarshal reply: %s", err)
+	}
+	if got.Text != "hello" {
+		t.Errorf("Expected reply %q, but got %q", "hello", got.Text)
+	}
+}
+
+func TestCallRemoteError(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterHandler("missing", func(msg *Message, client *Client) error {
+		return NewRemoteError(ErrCodeNotFound, "no such object")
+	})
+	s.RegisterHandler("broken", func(msg *Message, client *Client) error {
+		return errors.New("broken handler")
+	})
+	c := newTestClient(t, s)
+
+	tests := []struct {
+		messageType string
+		code        ErrorCode
+	}{
+		{"missing", ErrCodeNotFound},
+		{"broken", ErrCodeInternal},
+		{"unknown", ErrCodeNoHandler},
+	}
+	for _, tt := range tests {
+		_, err := c.Call(context.Background(), tt.messageType, nil)
+		var remoteErr *RemoteError
+		if !errors.As(err, &remoteErr) || remoteErr.Code != tt.code {
+			t.Errorf("Expected %s to fail with %s, but got %v", tt.messageType, tt.code, err)
+		}
+	}
+}
+
+// blockingHandler 阻塞到请求的上下文结束，并把上下文交给测试检查
+func blockingHandler(started chan<- context.Context) HandlerFunc {
+	return func(msg *Message, client *Client) error {
+		started <- msg.Context()
+		<-msg.Context().Done()
+		return msg.Context().Err()
+	}
+}
+
+func expectHandlerDone(t *testing.T, ctx context.Context) {
+	t.Helper()
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected the handler's context to be done")
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	s := newTestServer(t)
+	started := make(chan context.Context, 1)
+	s.RegisterHandler("block", blockingHandler(started))
+	c := newTestClient(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Call(ctx, "block", nil)
+		errs <- err
+	}()
+	handlerCtx := <-started
+	cancel()
+
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, but got %v", context.Canceled, err)
+	}
+	// 取消通过 cancel 消息传给对端的处理函数
+	expectHandlerDone(t, handlerCtx)
+	if err := handlerCtx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the handler's context to be canceled, but got %v", err)
+	}
+}
+
+func TestCallDeadline(t *testing.T) {
+	s := newTestServer(t)
+	started := make(chan context.Context, 1)
+	s.RegisterHandler("block", blockingHandler(started))
+	c := newTestClient(t, s)
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if _, err := c.Call(ctx, "block", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	handlerCtx := <-started
+	if got, ok := handlerCtx.Deadline(); !ok || got.UnixMilli() != deadline.UnixMilli() {
+		t.Errorf("Expected the handler's deadline to be %s, but got %s", deadline, got)
+	}
+	expectHandlerDone(t, handlerCtx)
+}
+
+func TestHandleAbandonsExpiredRequest(t *testing.T) {
+	h := NewMessageHandler(0)
+	called := false
+	h.RegisterHandler("late", func(msg *Message, client *Client) error {
+		called = true
+		return nil
+	})
+	c := &Client{rpc: newRPCState(), msg: make(chan *Message, 1), done: make(chan struct{})}
+
+	// 截止时间已过的请求不再处理，也不回复
+	msg := &Message{ID: "late", Type: "late", WantReply: true, Deadline: time.Now().Add(-time.Second).UnixMilli()}
+	c.rpc.begin(msg)
+	h.handle(msg, c)
+	if called {
+		t.Errorf("Expected the expired request to be abandoned, but the handler was called")
+	}
+	select {
+	case reply := <-c.msg:
+		t.Errorf("Expected no reply to the expired request, but got %+v", reply)
+	default:
+	}
+}
+
+func TestRegisterHandlerWhileServing(t *testing.T) {
+	s := newTestServer(t)
+	s.RegisterHandler("echo", func(msg *Message, client *Client) error {
+		return client.Reply(msg, echoRequest{Text: "pong"})
+	})
+	c := newTestClient(t, s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.RegisterHandler(fmt.Sprintf("extra-%d", i), func(msg *Message, client *Client) error { return nil })
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := c.Call(context.Background(), "echo", nil); err != nil {
+			t.Fatalf("Failed to call echo: %s", err)
+		}
+	}
+	<-done
+}
@@ -3,6 +3,10 @@ package quicnet
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +27,37 @@ type ScriptTask struct {
 	ScriptResult    *ScriptResult
 	Env             map[string]string
 	MachineID       string
+	// User、Group 为运行脚本的用户和用户组，可以是名称或数字 ID，为空时与 agent 相同
+	User  string
+	Group string
+	Dir   string
+	// Umask 为八进制的 umask，例如 "022"
+	Umask  string
+	Nice   int
+	Limits *ResourceLimits
+	// GracePeriod 为停止脚本时从 SIGTERM 到 SIGKILL 的等待时间，默认为 5 秒
+	GracePeriod time.Duration
+	// Cgroup 为脚本所在 cgroup 的资源上限，CgroupSlice 为 agent 的 slice，默认为 lops.slice
+	Cgroup      *CgroupLimits
+	CgroupSlice string
+	// Output 不为空时，脚本运行中产生的输出会实时交给 Output
+	Output func(chunk OutputChunk)
+	// Transitions 按时间顺序记录任务的状态变化
+	Transitions []TaskTransition
+
+	// ctx 为任务的上级上下文，请求方取消时脚本随之停止
+	ctx       context.Context
+	outputSeq atomic.Uint64
+	// mu 保护 Status、Updated、Transitions 和 Cancel，任务运行时可能被并发查询或停止
+	mu      sync.Mutex
+	stopped bool
+	done    chan struct{}
+}
+
+// TaskTransition 为任务的一次状态变化
+type TaskTransition struct {
+	Status TaskStatus `json:"status"`
+	Time   time.Time  `json:"time"`
 }
 
 type ScriptErrorCode string
@@ -35,6 +70,18 @@ const (
 	CodeTimeout              ScriptErrorCode = "TIMEOUT"
 	CodeStopped              ScriptErrorCode = "STOPPED"
 	CodeSuccess              ScriptErrorCode = "SUCCESS"
+	CodeStartFailed          ScriptErrorCode = "START_FAILED"
+	CodeInvalidOptions       ScriptErrorCode = "INVALID_OPTIONS"
+	CodeInvalidWorkDir       ScriptErrorCode = "INVALID_WORK_DIR"
+	CodeUserNotFound         ScriptErrorCode = "USER_NOT_FOUND"
+	CodeGroupNotFound        ScriptErrorCode = "GROUP_NOT_FOUND"
+	// CodePermissionDenied 表示 agent 没有权限按请求的用户、优先级或资源限制运行脚本
+	CodePermissionDenied ScriptErrorCode = "PERMISSION_DENIED"
+	CodeUnsupported      ScriptErrorCode = "UNSUPPORTED"
+	// CodeInterrupted 表示 agent 在脚本运行期间重启，脚本可能只执行了一部分且不会再次执行
+	CodeInterrupted ScriptErrorCode = "INTERRUPTED"
+	// CodeCgroupUnavailable 表示请求了 cgroup 资源上限，但无法为脚本创建或设置 cgroup
+	CodeCgroupUnavailable ScriptErrorCode = "CGROUP_UNAVAILABLE"
 )
 
 type ScriptResult struct {
@@ -45,19 +92,52 @@ type ScriptResult struct {
 	ExitCode  int
 	StartTime time.Time
 	EndTime   time.Time
+	// Usage 为脚本所在 cgroup 的资源使用情况，未使用 cgroup 时为 nil
+	Usage *ResourceUsage
 }
 
+const defaultScriptTimeout = 10 * time.Minute
+
 func NewScriptTask(request *ScriptTaskRequest) *ScriptTask {
+	timeout := time.Duration(request.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultScriptTimeout
+	}
+	now := time.Now()
 	return &ScriptTask{
-		TaskID:      request.TaskID,
-		Type:        request.Type,
-		Content:     request.Content,
-		Interpreter: request.Interpreter,
-		Stdin:       request.Stdin,
-		Status:      TaskStatusCreated,
-		Created:     time.Now(),
-		Updated:     time.Now(),
+		TaskID:       request.TaskID,
+		Type:         request.Type,
+		Content:      request.Content,
+		Interpreter:  request.Interpreter,
+		Stdin:        request.Stdin,
+		Timeout:      timeout,
+		Env:          request.Params,
+		User:         request.User,
+		Group:        request.Group,
+		Dir:          request.Dir,
+		Umask:        request.Umask,
+		Nice:         request.Nice,
+		Limits:       request.Limits,
+		GracePeriod:  time.Duration(request.GracePeriod) * time.Second,
+		Cgroup:       request.Cgroup,
+		Status:       TaskStatusCreated,
+		Created:      now,
+		Updated:      now,
+		Transitions:  []TaskTransition{{Status: TaskStatusCreated, Time: now}},
+		ScriptResult: &ScriptResult{},
+		done:         make(chan struct{}),
+	}
+}
+
+func (st *ScriptTask) context() context.Context {
+	if st.ctx != nil {
+		return st.ctx
 	}
+	return context.Background()
+}
+
+func (st *ScriptTask) GetTaskID() string {
+	return st.TaskID
 }
 
 func (st *ScriptTask) GetType() string {
@@ -65,6 +145,8 @@ func (st *ScriptTask) GetType() string {
 }
 
 func (st *ScriptTask) GetStatus() TaskStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 	return st.Status
 }
 
@@ -73,40 +155,147 @@ func (st *ScriptTask) GetContent() []byte {
 }
 
 func (st *ScriptTask) Run() error {
-	// 实现运行脚本的逻辑
-	// ...
+	if st.done != nil {
+		defer close(st.done)
+	}
 	NewCmdRunner().RunScript(st)
 	return nil
 }
 
+// Stop 停止正在运行的脚本，与超时相同，先向脚本的进程组发送 SIGTERM，
+// 超过 GracePeriod 后发送 SIGKILL；脚本尚未启动时启动后立即停止
 func (st *ScriptTask) Stop() error {
-	// 实现停止脚本的逻辑
-	st.Cancel()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stopped = true
+	if st.Cancel != nil {
+		st.Cancel()
+	}
 	return nil
 }
 
+// setCancel 记录停止脚本的函数，在此之前已调用过 Stop 时立即停止
+func (st *ScriptTask) setCancel(cancel context.CancelFunc) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Cancel = cancel
+	if st.stopped {
+		cancel()
+	}
+}
+
+// abandon 结束在排队中被取消或超时、未能运行的任务
+func (st *ScriptTask) abandon(err error) {
+	r := st.ScriptResult
+	if errors.Is(err, context.DeadlineExceeded) {
+		r.Error = "script execution timeout"
+		r.Code = CodeTimeout
+	} else {
+		r.Error = "script execution canceled"
+		r.Code = CodeStopped
+	}
+	if st.done != nil {
+		close(st.done)
+	}
+}
+
+// Done 返回在 Run 结束后关闭的 channel
+func (st *ScriptTask) Done() <-chan struct{} {
+	return st.done
+}
+
 func (st *ScriptTask) SetStatus(status TaskStatus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 	st.Status = status
 	st.Updated = time.Now()
+	st.Transitions = append(st.Transitions, TaskTransition{Status: status, Time: st.Updated})
+}
+
+// status 返回脚本结束后任务的状态，脚本正常退出且退出码为 0 时为 Completed
+func (r *ScriptResult) status() TaskStatus {
+	switch {
+	case r.Code == CodeStopped:
+		return TaskStatusStopped
+	case r.Code == CodeSuccess && r.ExitCode == 0:
+		return TaskStatusCompleted
+	default:
+		return TaskStatusFailed
+	}
 }
 
 func HandlerScriptTask(msg *Message, c *Client) (err error) {
+	if msg.IsReply() {
+		return nil
+	}
+
 	var reqtask ScriptTaskRequest
 	err = json.Unmarshal(msg.Data, &reqtask)
 	if err != nil {
-		return
+		return NewRemoteError(ErrCodeBadRequest, "invalid script task: %s", err)
+	}
+
+	// 同一 TaskID 只执行一次，重复下发的任务直接回复首次执行的结果
+	run, first := c.beginTaskRun(reqtask.TaskID)
+	if !first {
+		log.Printf("Task %s is already executed, waiting for its result", reqtask.TaskID)
+		select {
+		case <-run.done:
+			if run.err != nil {
+				return run.err
+			}
+			return c.Reply(msg, run.result)
+		case <-msg.Context().Done():
+			return msg.Context().Err()
+		}
 	}
+	defer close(run.done)
 
 	scriptTask := NewScriptTask(&reqtask)
-	err = scriptTask.Run()
-	if err != nil {
-		return
+	// 排队中的任务同样可以通过 Stop 取消
+	ctx, cancel := context.WithCancel(msg.Context())
+	defer cancel()
+	scriptTask.ctx = ctx
+	scriptTask.setCancel(cancel)
+	scriptTask.CgroupSlice = c.executor.cfg.CgroupSlice
+	c.tm.AddTask(scriptTask)
+	// 服务端不支持实时输出时只在结束后随结果发送
+	if reqtask.StreamOutput && c.PeerSupports(msgTypeTaskOutput) {
+		scriptTask.Output = func(chunk OutputChunk) {
+			c.sendOutput(msg, chunk)
+		}
 	}
-	data, err := json.Marshal(scriptTask.ScriptResult)
-	if err != nil {
-		return
+
+	release, err := c.executor.acquire(ctx, reqtask.TaskID, reqtask.Type, reqtask.Priority)
+	switch {
+	case errors.Is(err, ErrQueueFull):
+		// 被拒绝的任务不算执行过，可以稍后重新下发
+		c.tm.RemoveTask(reqtask.TaskID)
+		run.err = NewRemoteError(ErrCodeQueueFull, "task %s rejected: %s", reqtask.TaskID, err)
+		c.taskRuns.remove(reqtask.TaskID)
+		return run.err
+	case err != nil:
+		scriptTask.abandon(err)
+	default:
+		if c.taskLog != nil {
+			c.taskLog.start(reqtask.TaskID)
+		}
+		c.tm.UpdateTaskStatus(scriptTask.TaskID, TaskStatusRunning)
+		err = scriptTask.Run()
+		release()
+		if err != nil {
+			c.tm.UpdateTaskStatus(scriptTask.TaskID, TaskStatusFailed)
+			run.err = err
+			if c.taskLog != nil {
+				c.taskLog.finish(reqtask.TaskID, nil, err)
+			}
+			return
+		}
+	}
+	c.tm.UpdateTaskStatus(scriptTask.TaskID, scriptTask.ScriptResult.status())
+	run.result = scriptTask.ScriptResult
+	if c.taskLog != nil {
+		c.taskLog.finish(reqtask.TaskID, run.result, nil)
 	}
-	msg.Data = data
-	c.SendMsg(msg)
-	return
+	return c.Reply(msg, scriptTask.ScriptResult)
 }
@@ -0,0 +1,336 @@
+package quicnet
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// Selector 是按标签和主机信息筛选 agent 的表达式，例如：
+//
+//	env=prod and role in (web,api) and not hostname~"db-*"
+//
+// 支持 =、==、!=、~（glob 匹配）、!~、in (...)、notin (...)、只写键名表示键存在，
+// 以及 and、or、not 和括号
+type Selector struct {
+	expr string
+	root selectorNode
+}
+
+type selectorNode interface {
+	match(attrs map[string]string) bool
+}
+
+func ParseSelector(expr string) (*Selector, error) {
+	tokens, err := lexSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("selector: unexpected %q at %d", tok.text, tok.pos)
+	}
+	return &Selector{expr: expr, root: root}, nil
+}
+
+func (s *Selector) Match(attrs map[string]string) bool {
+	return s.root.match(attrs)
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type selectorToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-./:*?[]", r)
+}
+
+func lexSelector(expr string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, selectorToken{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, selectorToken{tokRParen, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, selectorToken{tokComma, ",", i})
+			i++
+		case r == '=' || r == '!' || r == '~':
+			start := i
+			i++
+			if i < len(runes) && (runes[i] == '=' || runes[i] == '~') {
+				i++
+			}
+			op := string(runes[start:i])
+			if op != "=" && op != "==" && op != "!=" && op != "~" && op != "!~" {
+				return nil, fmt.Errorf("selector: unknown operator %q at %d", op, start)
+			}
+			tokens = append(tokens, selectorToken{tokOp, op, start})
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("selector: unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, selectorToken{tokString, sb.String(), start})
+		case isIdentRune(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, selectorToken{tokIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("selector: unexpected character %q at %d", r, i)
+		}
+	}
+	return append(tokens, selectorToken{tokEOF, "", len(runes)}), nil
+}
+
+type selectorParser struct {
+	tokens []selectorToken
+	pos    int
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.pos]
+}
+
+func (p *selectorParser) next() selectorToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *selectorParser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokIdent && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) parseOr() (selectorNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseAnd() (selectorNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *selectorParser) parseUnary() (selectorNode, error) {
+	if p.keyword("not") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, fmt.Errorf("selector: expected ) at %d", tok.pos)
+		}
+		return n, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *selectorParser) parseCondition() (selectorNode, error) {
+	keyTok := p.next()
+	if keyTok.kind != tokIdent && keyTok.kind != tokString {
+		return nil, fmt.Errorf("selector: expected key at %d", keyTok.pos)
+	}
+	key := keyTok.text
+
+	tok := p.peek()
+	switch {
+	case tok.kind == tokOp:
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		switch tok.text {
+		case "=", "==":
+			return equalNode{key, value}, nil
+		case "!=":
+			return notNode{equalNode{key, value}}, nil
+		case "~":
+			return globNode{key, value}, nil
+		default:
+			return notNode{globNode{key, value}}, nil
+		}
+	case p.keyword("in"):
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return inNode{key, values}, nil
+	case p.keyword("notin"):
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inNode{key, values}}, nil
+	}
+	return existsNode{key}, nil
+}
+
+func (p *selectorParser) parseValue() (string, error) {
+	tok := p.next()
+	if tok.kind != tokIdent && tok.kind != tokString {
+		return "", fmt.Errorf("selector: expected value at %d", tok.pos)
+	}
+	return tok.text, nil
+}
+
+func (p *selectorParser) parseList() ([]string, error) {
+	if tok := p.next(); tok.kind != tokLParen {
+		return nil, fmt.Errorf("selector: expected ( at %d", tok.pos)
+	}
+	var values []string
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		tok := p.next()
+		if tok.kind == tokRParen {
+			return values, nil
+		}
+		if tok.kind != tokComma {
+			return nil, fmt.Errorf("selector: expected , or ) at %d", tok.pos)
+		}
+	}
+}
+
+type andNode struct{ left, right selectorNode }
+
+func (n andNode) match(attrs map[string]string) bool {
+	return n.left.match(attrs) && n.right.match(attrs)
+}
+
+type orNode struct{ left, right selectorNode }
+
+func (n orNode) match(attrs map[string]string) bool {
+	return n.left.match(attrs) || n.right.match(attrs)
+}
+
+type notNode struct{ node selectorNode }
+
+func (n notNode) match(attrs map[string]string) bool {
+	return !n.node.match(attrs)
+}
+
+type existsNode struct{ key string }
+
+func (n existsNode) match(attrs map[string]string) bool {
+	_, ok := attrs[n.key]
+	return ok
+}
+
+type equalNode struct{ key, value string }
+
+func (n equalNode) match(attrs map[string]string) bool {
+	v, ok := attrs[n.key]
+	return ok && v == n.value
+}
+
+type globNode struct{ key, pattern string }
+
+func (n globNode) match(attrs map[string]string) bool {
+	v, ok := attrs[n.key]
+	if !ok {
+		return false
+	}
+	matched, err := path.Match(n.pattern, v)
+	return err == nil && matched
+}
+
+type inNode struct {
+	key    string
+	values []string
+}
+
+func (n inNode) match(attrs map[string]string) bool {
+	v, ok := attrs[n.key]
+	if !ok {
+		return false
+	}
+	for _, value := range n.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
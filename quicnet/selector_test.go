@@ -0,0 +1,62 @@
+package quicnet
+
+import (
+	"testing"
+)
+
+func TestSelectorMatch(t *testing.T) {
+	attrs := map[string]string{
+		"env":      "prod",
+		"role":     "web",
+		"hostname": "web-01",
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`env=prod`, true},
+		{`env==prod`, true},
+		{`env!=prod`, false},
+		{`role in (web,api)`, true},
+		{`role notin (web, api)`, false},
+		{`hostname~"web-*"`, true},
+		{`hostname!~'web-*'`, false},
+		{`env=prod and role in (web,api) and not hostname~"db-*"`, true},
+		{`env=staging or role=web`, true},
+		{`env=staging or (role=web and zone=a)`, false},
+		{`zone`, false},
+		{`not zone and env`, true},
+		{`ENV=prod`, false},
+		{`env=prod AND role=web`, true},
+	}
+
+	for _, tt := range tests {
+		selector, err := ParseSelector(tt.expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", tt.expr, err)
+			continue
+		}
+		if matched := selector.Match(attrs); matched != tt.expected {
+			t.Errorf("Expected %q to match %v, but got %v", tt.expr, tt.expected, matched)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	exprs := []string{
+		`env=`,
+		`env = prod and`,
+		`role in (web`,
+		`(env=prod`,
+		`env=prod)`,
+		`hostname~"web-*`,
+		`env => prod`,
+	}
+
+	for _, expr := range exprs {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Errorf("Expected %q to fail to parse", expr)
+		}
+	}
+}
@@ -4,82 +4,360 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"time"
 
 	quic "github.com/quic-go/quic-go"
 )
 
+const (
+	serverMessageWorkers  = 10
+	presenceSweepInterval = 10 * time.Second
+)
+
 type Server struct {
 	listener       quic.Listener
 	cm             *ClientManager
 	messageHandler *MessageHandler
+	tasks          *pendingTasks
+	outbox         *outbox
+	output         *outputHub
+	closed         chan struct{}
+	identityFunc   IdentityFunc
+	requireID      bool
+	ca             *CA
+	tokens         *TokenStore
+	crl            *RevocationList
+	policy         *Policy
+	audit          AuditFunc
+	maxFrameSize   int
+	redelivery     time.Duration
+}
+
+type ServerOption func(*Server)
+
+// WithIdentityFunc 设置从客户端证书取 MachineID 的方式，默认为 MachineIDFromCertificate
+func WithIdentityFunc(fn IdentityFunc) ServerOption {
+	return func(s *Server) {
+		s.identityFunc = fn
+	}
 }
 
-func NewServer(addr string, tlsCfg *tls.Config, quicCfg *quic.Config) (*Server, error) {
-	listener, err := quic.ListenAddr(addr, tlsCfg, quicCfg)
+func NewServer(addr string, tlsCfg *tls.Config, quicCfg *quic.Config, opts ...ServerOption) (*Server, error) {
+	s := &Server{
+		cm:             NewClientManager(),
+		messageHandler: NewMessageHandler(100),
+		tasks:          newPendingTasks(),
+		outbox:         newOutbox(),
+		output:         newOutputHub(),
+		closed:         make(chan struct{}),
+		identityFunc:   MachineIDFromCertificate,
+		maxFrameSize:   defaultMaxFrameSize,
+		redelivery:     defaultRedeliveryWindow,
+		requireID:      tlsCfg != nil && tlsCfg.ClientAuth == tls.RequireAndVerifyClientCert,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	listener, err := quic.ListenAddr(addr, s.serverTLSConfig(tlsCfg), quicCfg)
 	if err != nil {
 		return nil, err
 	}
+	s.listener = listener
+	s.cm.onEvict = func(client *Client) {
+		s.tasks.failFor(client.MachineID, ErrClientDisconnected)
+	}
+	s.messageHandler.RegisterHandler("heartbeat", s.HandleHeartbeat)
+	s.messageHandler.RegisterHandler("script_task", s.HandleScriptResult)
+	s.messageHandler.RegisterHandler(msgTypeEnroll, s.HandleEnroll)
+	s.messageHandler.RegisterHandler(msgTypeCertRenew, s.HandleCertRenew)
+	s.messageHandler.RegisterHandler(msgTypeTaskOutput, s.HandleTaskOutput)
+	return s, nil
+}
 
-	return &Server{
-		listener: listener,
-		cm:       NewClientManager(),
-	}, nil
+// serverTLSConfig 在握手时拒绝已吊销的客户端证书
+func (s *Server) serverTLSConfig(tlsCfg *tls.Config) *tls.Config {
+	if s.crl == nil || tlsCfg == nil {
+		return tlsCfg
+	}
+	cfg := tlsCfg.Clone()
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		cert := state.PeerCertificates[0]
+		machineID, _ := s.identityFunc(cert)
+		if s.crl.IsRevoked(cert.SerialNumber, machineID) {
+			return ErrCertificateRevoked
+		}
+		return nil
+	}
+	return cfg
 }
 
 func (s *Server) Close() {
+	select {
+	case <-s.closed:
+		return
+	default:
+		close(s.closed)
+	}
+	// 先关闭连接再关闭 listener，否则关闭通知无法发送给 agent
+	for _, client := range s.cm.ListClients() {
+		client.Close()
+	}
 	s.listener.Close()
 }
 
+func (s *Server) ClientManager() *ClientManager {
+	return s.cm
+}
+
+// RegisterHandler 注册服务端对 agent 上报消息的处理函数，同类型会覆盖默认处理。
+// 可以在服务端运行中调用，但此前已建立的连接在握手中声明的消息类型不会更新
+func (s *Server) RegisterHandler(messageType string, handler HandlerFunc) {
+	s.messageHandler.RegisterHandler(messageType, handler)
+}
+
 func (s *Server) Accept() (*Client, error) {
 	session, err := s.listener.Accept(context.Background())
 	if err != nil {
 		return nil, err
 	}
+	return s.acceptClient(session)
+}
 
+// acceptClient 接受 agent 打开的第一个流并完成 Hello 握手，协议不兼容时关闭连接
+func (s *Server) acceptClient(session quic.Connection) (*Client, error) {
 	stream, err := session.AcceptStream(context.Background())
 	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, err
+	}
+	peer, err := serverHello(stream, localHello(s.messageHandler, codecNames(), s.maxFrameSize, true))
+	if err != nil {
+		var incompatible *IncompatibleError
+		if errors.As(err, &incompatible) {
+			// 给 agent 读取拒绝原因的时间，agent 读到后会自行关闭连接
+			select {
+			case <-session.Context().Done():
+			case <-time.After(refuseGracePeriod):
+			}
+		}
+		session.CloseWithError(CloseIncompatible, err.Error())
 		return nil, err
 	}
 
-	return &Client{
-		session: session,
-		stream:  stream,
-	}, nil
+	c := &Client{
+		session:      session,
+		stream:       stream,
+		peer:         peer,
+		msg:          make(chan *Message, 100),
+		rpc:          newRPCState(),
+		seen:         newDedupeWindow(defaultDedupeWindow),
+		done:         make(chan struct{}),
+		maxFrameSize: s.maxFrameSize,
+		compression:  true,
+		stats:        newFrameStats(),
+	}
+	if addr, ok := session.RemoteAddr().(*net.UDPAddr); ok {
+		c.IP = addr.IP.String()
+	}
+	c.deliver = func(msg *Message) {
+		s.deliver(c, msg)
+	}
+	go c.prosessMsg()
+	return c, nil
 }
 
-func (s *Server) HandleHeartbeat(client *Client, msg *Message) {
+func (s *Server) HandleHeartbeat(msg *Message, client *Client) error {
 	var heartbeat HeartbeatData
 	err := json.Unmarshal(msg.Data, &heartbeat)
 	if err != nil {
-		log.Printf("Failed to unmarshal heartbeat message: %s", err)
-		return
+		return fmt.Errorf("failed to unmarshal heartbeat message: %w", err)
+	}
+	if heartbeat.MachineID == "" {
+		return errors.New("heartbeat without machine id")
+	}
+	// 使用客户端证书时 MachineID 必须与证书中的身份一致
+	if client.Identity != nil && client.Identity.MachineID != heartbeat.MachineID {
+		log.Printf("Rejecting heartbeat from %s: machine id %s does not match certificate", client.Identity.MachineID, heartbeat.MachineID)
+		client.CloseWithError(CloseIdentityMismatch, "machine id does not match certificate")
+		return nil
+	}
+
+	state, err := s.cm.admit(client, &heartbeat)
+	if err != nil {
+		log.Printf("Rejecting agent %s: %s", heartbeat.MachineID, err)
+		client.CloseWithError(CloseKeyRejected, err.Error())
+		return nil
+	}
+
+	// 首个心跳完成注册，未接受的 agent 同样登记，但不能接收任务
+	if s.cm.Register(client, &heartbeat) {
+		// 接受连接后吊销的证书在注册后再检查一次
+		if s.revoked(client.Identity) {
+			log.Printf("Disconnecting %s: certificate %s revoked", client.Identity.MachineID, client.Identity.SerialNumber)
+			client.CloseWithError(CloseRevoked, "certificate revoked")
+			return nil
+		}
+		log.Printf("Client %s (%s) registered, key %s", heartbeat.MachineID, heartbeat.Hostname, state)
+		if state == KeyAccepted {
+			s.redeliver(client)
+		}
 	}
+	return nil
+}
 
-	client.IP = heartbeat.IP
-	client.MachineID = heartbeat.MachineID
-	client.Hostname = heartbeat.Hostname
-	s.cm.AddClient(client)
+// HandleScriptResult 将 agent 回复的脚本结果交给等待中的 Dispatch，没有等待者的结果仅记录日志
+func (s *Server) HandleScriptResult(msg *Message, client *Client) error {
+	if !msg.IsReply() {
+		return NewRemoteError(ErrCodeBadRequest, "agents cannot run script tasks on the server")
+	}
+	if s.resolveTask(msg, client) {
+		return nil
+	}
+	if err := msg.Err(); err != nil {
+		log.Printf("Script task %s on %s failed: %s", msg.ReplyTo, client.MachineID, err)
+		return nil
+	}
+	var result ScriptResult
+	err := json.Unmarshal(msg.Data, &result)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal script result: %w", err)
+	}
+	log.Printf("Script task %s on %s finished: code=%s exit=%d", msg.ReplyTo, client.MachineID, result.Code, result.ExitCode)
+	return nil
 }
 
 func (s *Server) Start() {
+	s.messageHandler.HandleMessages(nil, serverMessageWorkers)
+	stopSweeper := s.cm.StartSweeper(presenceSweepInterval)
+	defer stopSweeper()
 	for {
-		client, err := s.Accept()
+		session, err := s.listener.Accept(context.Background())
 		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
 			log.Printf("Failed to accept client: %s", err)
 			continue
 		}
 
 		go func() {
-			for {
-				msg, err := client.Read()
-				if err != nil {
-					log.Printf("Failed to read message from client: %s", err)
-					return
-				}
-				_ = msg
-				//s.messageHandler.SubmitMessage(msg)
+			identity, err := peerIdentity(session, s.identityFunc)
+			// 启用入网时允许没有证书的连接，但只能发送入网请求
+			if err != nil || (identity == nil && s.requireID && s.tokens == nil) {
+				log.Printf("Rejecting connection from %s: no valid identity: %v", session.RemoteAddr(), err)
+				session.CloseWithError(CloseUnauthenticated, "no valid client identity")
+				return
+			}
+			// 握手之后、注册之前吊销的证书不在已注册的连接中，disconnectRevoked 无法断开
+			if s.revoked(identity) {
+				log.Printf("Rejecting connection from %s: certificate %s revoked", identity.MachineID, identity.SerialNumber)
+				session.CloseWithError(CloseRevoked, "certificate revoked")
+				return
 			}
+			client, err := s.acceptClient(session)
+			if err != nil {
+				log.Printf("Failed to accept client %s: %s", session.RemoteAddr(), err)
+				return
+			}
+			client.Identity = identity
+			client.onAck = func(id string) {
+				s.outbox.ack(client.MachineID, id)
+			}
+			go client.acceptStreams(session)
+			s.serveClient(client)
 		}()
 	}
 }
+
+// serveClient 读取连接上的消息并交给 messageHandler 分发，读循环结束后注销该连接
+func (s *Server) serveClient(client *Client) {
+	defer func() {
+		client.Close()
+		if s.cm.Disconnect(client) {
+			log.Printf("Client %s disconnected", client.MachineID)
+		}
+	}()
+
+	for {
+		msg, err := client.ReadMessage()
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			log.Printf("Failed to unmarshal message: %s", err)
+			continue
+		}
+		var tooLarge *FrameTooLargeError
+		if errors.As(err, &tooLarge) {
+			log.Printf("Closing connection from %s: %s", client.MachineID, err)
+			client.CloseWithError(CloseFrameTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !client.IsClosed() {
+				log.Printf("Failed to read message from client: %s", err)
+			}
+			return
+		}
+		if client.handleIncoming(msg) {
+			continue
+		}
+		s.deliver(client, msg)
+	}
+}
+
+// deliver 将控制流或独占流上收到的消息授权后交给 messageHandler
+func (s *Server) deliver(client *Client, msg *Message) {
+	if err := s.authorize(client, msg); err != nil {
+		if msg.IsReply() {
+			// 被拒绝的回复同样确认，避免 agent 在重连后不断重发
+			log.Printf("Dropping reply %s to %s from %s: %s", msg.ID, msg.ReplyTo, client.MachineID, err)
+			client.sendAck(msg)
+		}
+		if msg.WantReply {
+			client.ReplyError(msg, err)
+		}
+		client.rpc.finish(msg.ID)
+		return
+	}
+	// 心跳和输出块在读循环中直接处理：心跳完成注册后才处理该连接随后的消息，
+	// 输出块先于同一流上随后到达的任务结果
+	if msg.Type == "heartbeat" || msg.Type == msgTypeTaskOutput {
+		s.messageHandler.handle(msg, client)
+		return
+	}
+	s.messageHandler.SubmitClientMessage(client, msg)
+}
+
+// authorize 检查连接是否允许发送该消息，未认证的连接只能发送入网请求；
+// 启用 Policy 时 agent 的请求还需通过授权检查，只有对下发给该 agent 且仍在等待结果的任务的回复不做检查
+func (s *Server) authorize(client *Client, msg *Message) error {
+	if client.Identity == nil && s.requireID && msg.Type != msgTypeEnroll {
+		return NewRemoteError(ErrCodeUnauthenticated, "client certificate required for %s", msg.Type)
+	}
+	if s.policy == nil {
+		return nil
+	}
+	if msg.IsReply() && s.tasks.pendingFor(msg.ReplyTo, client.MachineID) {
+		return nil
+	}
+	principal := Principal{Kind: PrincipalAgent, Name: client.MachineID}
+	if client.Identity != nil {
+		principal.Name = client.Identity.MachineID
+	}
+	return s.checkPolicy(principal, msg, nil)
+}
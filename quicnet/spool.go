@@ -0,0 +1,391 @@
+package quicnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentSuffix     = ".seg"
+	defaultSpoolSegment    = 4 << 20
+	defaultSpoolMaxBytes   = 256 << 20
+	defaultSpoolMaxAge     = 7 * 24 * time.Hour
+	spoolOpPut             = "put"
+	spoolOpAck             = "ack"
+	spoolSegmentNameFormat = "%016d" + spoolSegmentSuffix
+	maxSpoolRecordSize     = 64 << 20
+)
+
+var ErrSpoolClosed = errors.New("spool closed")
+
+type SpoolConfig struct {
+	Dir string
+	// SegmentSize 为单个段文件的大小上限，默认 4 MiB
+	SegmentSize int64
+	// MaxBytes 为所有段文件的总大小上限，超过时丢弃最旧的段，默认 256 MiB
+	MaxBytes int64
+	// MaxAge 为消息的最长保留时间，默认 7 天
+	MaxAge time.Duration
+}
+
+// Spool 是待发送消息的磁盘队列。消息和确认都以追加方式写入段文件，
+// 段内所有消息都被确认、且其中的确认记录所指向的段都已删除后删除该段
+type Spool struct {
+	cfg SpoolConfig
+
+	mu        sync.Mutex
+	segments  []*spoolSegment
+	active    *os.File
+	entries   map[string]*spoolEntry
+	nextSeq   uint64
+	nextOrder uint64
+	closed    bool
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+	live int
+	// acked 为本段中的确认记录所确认的消息所在的段，这些段删除前本段必须保留，
+	// 否则重启后这些消息会重新出现
+	acked map[uint64]struct{}
+}
+
+func (seg *spoolSegment) addAck(target *spoolSegment) {
+	if target == seg {
+		return
+	}
+	if seg.acked == nil {
+		seg.acked = make(map[uint64]struct{})
+	}
+	seg.acked[target.seq] = struct{}{}
+}
+
+type spoolEntry struct {
+	order   uint64
+	segment *spoolSegment
+	created time.Time
+	msg     *Message
+}
+
+type spoolRecord struct {
+	Op      string    `json:"op"`
+	ID      string    `json:"id"`
+	Created time.Time `json:"created,omitempty"`
+	Msg     *Message  `json:"msg,omitempty"`
+}
+
+func OpenSpool(cfg SpoolConfig) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("spool directory is required")
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSpoolSegment
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSpoolMaxBytes
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultSpoolMaxAge
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		cfg:     cfg,
+		entries: make(map[string]*spoolEntry),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.cfg.Dir, "*"+spoolSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		var seq uint64
+		if _, err := fmt.Sscanf(filepath.Base(path), spoolSegmentNameFormat, &seq); err != nil {
+			log.Printf("Ignoring unknown spool file %s", path)
+			continue
+		}
+		seg := &spoolSegment{seq: seq, path: path}
+		if err := s.replay(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.nextSeq = seq + 1
+	}
+
+	// 已全部确认的旧段直接删除，之后的写入总是新建段
+	s.compact()
+	return nil
+}
+
+func (s *Spool) replay(seg *spoolSegment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolRecordSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		seg.size += int64(len(line)) + 1
+
+		var rec spoolRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// 进程崩溃时最后一条记录可能只写了一半
+			log.Printf("Truncated spool record in %s: %s", seg.path, err)
+			break
+		}
+		switch rec.Op {
+		case spoolOpPut:
+			if rec.Msg == nil {
+				continue
+			}
+			s.nextOrder++
+			s.entries[rec.ID] = &spoolEntry{order: s.nextOrder, segment: seg, created: rec.Created, msg: rec.Msg}
+			seg.live++
+		case spoolOpAck:
+			if e, ok := s.entries[rec.ID]; ok {
+				e.segment.live--
+				seg.addAck(e.segment)
+				delete(s.entries, rec.ID)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Spool) append(rec *spoolRecord) (*spoolSegment, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	if len(data) > maxSpoolRecordSize {
+		return nil, fmt.Errorf("spool record of %d bytes exceeds limit", len(data))
+	}
+
+	if s.active == nil || s.activeFull(int64(len(data))) {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.active.Write(data); err != nil {
+		return nil, err
+	}
+	if err := s.active.Sync(); err != nil {
+		return nil, err
+	}
+	seg.size += int64(len(data))
+	return seg, nil
+}
+
+func (s *Spool) activeFull(n int64) bool {
+	seg := s.segments[len(s.segments)-1]
+	return seg.size > 0 && seg.size+n > s.cfg.SegmentSize
+}
+
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	seg := &spoolSegment{seq: s.nextSeq, path: filepath.Join(s.cfg.Dir, fmt.Sprintf(spoolSegmentNameFormat, s.nextSeq))}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.active = f
+	s.segments = append(s.segments, seg)
+	s.compact()
+	return nil
+}
+
+// compact 删除除当前写入段外所有消息都已确认、且所确认的段都已删除的段，
+// 并在超过总大小上限时丢弃最旧的段
+func (s *Spool) compact() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	kept := s.segments[:0]
+	keptSeqs := make(map[uint64]struct{})
+	for i, seg := range s.segments {
+		last := i == len(s.segments)-1
+		if !last && ((seg.live <= 0 && !seg.acksKept(keptSeqs)) || total > s.cfg.MaxBytes) {
+			if seg.live > 0 {
+				log.Printf("Spool exceeds %d bytes, dropping %d messages in %s", s.cfg.MaxBytes, seg.live, seg.path)
+				s.dropSegment(seg)
+			}
+			total -= seg.size
+			os.Remove(seg.path)
+			continue
+		}
+		kept = append(kept, seg)
+		keptSeqs[seg.seq] = struct{}{}
+	}
+	s.segments = kept
+}
+
+// acksKept 判断本段确认的消息是否还有所在段未被删除
+func (seg *spoolSegment) acksKept(kept map[uint64]struct{}) bool {
+	for seq := range seg.acked {
+		if _, ok := kept[seq]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spool) dropSegment(seg *spoolSegment) {
+	for id, e := range s.entries {
+		if e.segment == seg {
+			delete(s.entries, id)
+		}
+	}
+	seg.live = 0
+}
+
+// Put 将消息持久化，直到 Ack 前都会出现在 Pending 中
+func (s *Spool) Put(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	if _, ok := s.entries[msg.ID]; ok {
+		return nil
+	}
+	now := time.Now()
+	seg, err := s.append(&spoolRecord{Op: spoolOpPut, ID: msg.ID, Created: now, Msg: msg})
+	if err != nil {
+		return err
+	}
+	s.nextOrder++
+	s.entries[msg.ID] = &spoolEntry{order: s.nextOrder, segment: seg, created: now, msg: msg}
+	seg.live++
+
+	if s.totalSize() > s.cfg.MaxBytes {
+		s.compact()
+	}
+	return nil
+}
+
+// Ack 记录消息已被对端确认，段内消息全部确认后删除该段
+func (s *Spool) Ack(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	e, ok := s.entries[id]
+	if !ok {
+		return nil
+	}
+	delete(s.entries, id)
+	e.segment.live--
+
+	// 消息所在的段可以删除时不必再写确认记录
+	if e.segment.live <= 0 && e.segment != s.segments[len(s.segments)-1] {
+		s.compact()
+		if !s.hasSegment(e.segment) {
+			return nil
+		}
+	}
+	seg, err := s.append(&spoolRecord{Op: spoolOpAck, ID: id})
+	if err != nil {
+		return err
+	}
+	seg.addAck(e.segment)
+	return nil
+}
+
+func (s *Spool) hasSegment(seg *spoolSegment) bool {
+	for _, kept := range s.segments {
+		if kept == seg {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending 按写入顺序返回尚未确认且未过期的消息，过期消息会被丢弃
+func (s *Spool) Pending() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*spoolEntry, 0, len(s.entries))
+	now := time.Now()
+	for id, e := range s.entries {
+		if now.Sub(e.created) > s.cfg.MaxAge {
+			log.Printf("Dropping expired spooled message %s (%s)", id, e.msg.Type)
+			delete(s.entries, id)
+			e.segment.live--
+			continue
+		}
+		entries = append(entries, e)
+	}
+	s.compact()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].order < entries[j].order })
+	msgs := make([]*Message, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.msg
+	}
+	return msgs
+}
+
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *Spool) totalSize() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Close 关闭当前段文件，之后的 Put 和 Ack 返回 ErrSpoolClosed
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
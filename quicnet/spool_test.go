@@ -0,0 +1,171 @@
+package quicnet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolPersistsUntilAck(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %s", err)
+	}
+	for _, id := range []string{"m1", "m2", "m3"} {
+		if err := spool.Put(&Message{ID: id, Type: "script_task", Data: []byte(id)}); err != nil {
+			t.Fatalf("Failed to put %s: %s", id, err)
+		}
+	}
+	if err := spool.Ack("m2"); err != nil {
+		t.Fatalf("Failed to ack: %s", err)
+	}
+	spool.Close()
+
+	// 重新打开后未确认的消息按写入顺序保留
+	spool, err = OpenSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen spool: %s", err)
+	}
+	defer spool.Close()
+
+	pending := spool.Pending()
+	if len(pending) != 2 || pending[0].ID != "m1" || pending[1].ID != "m3" {
+		t.Fatalf("Expected pending messages m1, m3, but got %v", messageIDs(pending))
+	}
+	if string(pending[1].Data) != "m3" {
+		t.Errorf("Expected message data to survive reopen, but got %q", pending[1].Data)
+	}
+}
+
+func TestSpoolRemovesAckedSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(SpoolConfig{Dir: dir, SegmentSize: 200})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %s", err)
+	}
+	defer spool.Close()
+
+	for _, id := range []string{"m1", "m2", "m3", "m4"} {
+		if err := spool.Put(&Message{ID: id, Type: "script_task", Data: make([]byte, 100)}); err != nil {
+			t.Fatalf("Failed to put %s: %s", id, err)
+		}
+	}
+	before := segmentFiles(t, dir)
+	if before < 2 {
+		t.Fatalf("Expected messages to span several segments, but got %d", before)
+	}
+
+	for _, id := range []string{"m1", "m2", "m3"} {
+		spool.Ack(id)
+	}
+	if after := segmentFiles(t, dir); after != 1 {
+		t.Errorf("Expected only the active segment to remain, but got %d files", after)
+	}
+	if spool.Len() != 1 {
+		t.Errorf("Expected 1 pending message, but got %d", spool.Len())
+	}
+}
+
+func TestSpoolKeepsAcksAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := OpenSpool(SpoolConfig{Dir: dir, SegmentSize: 500})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %s", err)
+	}
+	for _, id := range []string{"m1", "m2", "m3"} {
+		if err := spool.Put(&Message{ID: id, Type: "script_task", Data: make([]byte, 60)}); err != nil {
+			t.Fatalf("Failed to put %s: %s", id, err)
+		}
+	}
+	// m1、m2 在第一个段中，m1 的确认写在 m3 所在的段中，该段随后不再有未确认的消息
+	spool.Ack("m3")
+	spool.Ack("m1")
+	if err := spool.Put(&Message{ID: "m4", Type: "script_task", Data: make([]byte, 400)}); err != nil {
+		t.Fatalf("Failed to put m4: %s", err)
+	}
+	spool.Close()
+
+	spool, err = OpenSpool(SpoolConfig{Dir: dir, SegmentSize: 500})
+	if err != nil {
+		t.Fatalf("Failed to reopen spool: %s", err)
+	}
+	defer spool.Close()
+	pending := messageIDs(spool.Pending())
+	if len(pending) != 2 || pending[0] != "m2" || pending[1] != "m4" {
+		t.Errorf("Expected pending messages m2, m4 after reopen, but got %v", pending)
+	}
+
+	// 被引用的段删除后，只含确认记录的段也会被删除
+	spool.Ack("m2")
+	spool.Ack("m4")
+	spool.Put(&Message{ID: "m5", Type: "script_task", Data: make([]byte, 400)})
+	if n := segmentFiles(t, dir); n != 1 {
+		t.Errorf("Expected only the active segment to remain, but got %d files", n)
+	}
+}
+
+func TestSpoolDropsExpiredMessages(t *testing.T) {
+	spool, err := OpenSpool(SpoolConfig{Dir: t.TempDir(), MaxAge: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %s", err)
+	}
+	defer spool.Close()
+
+	spool.Put(&Message{ID: "m1", Type: "script_task"})
+	time.Sleep(5 * time.Millisecond)
+	if pending := spool.Pending(); len(pending) != 0 {
+		t.Errorf("Expected expired messages to be dropped, but got %v", messageIDs(pending))
+	}
+}
+
+func messageIDs(msgs []*Message) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return ids
+}
+
+func segmentFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read spool dir: %s", err)
+	}
+	n := 0
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == spoolSegmentSuffix {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSpoolClosed(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open spool: %s", err)
+	}
+	if err := spool.Put(&Message{ID: "m1", Type: "script_task"}); err != nil {
+		t.Fatalf("Failed to put m1: %s", err)
+	}
+	spool.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentSuffix))
+
+	// 关闭后不再写入，也不会创建新的段文件
+	if err := spool.Put(&Message{ID: "m2", Type: "script_task"}); err != ErrSpoolClosed {
+		t.Errorf("Expected %v from Put after Close, but got %v", ErrSpoolClosed, err)
+	}
+	if err := spool.Ack("m1"); err != ErrSpoolClosed {
+		t.Errorf("Expected %v from Ack after Close, but got %v", ErrSpoolClosed, err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentSuffix))
+	if len(after) != len(segments) {
+		t.Errorf("Expected %d segment files after Close, but got %d", len(segments), len(after))
+	}
+}
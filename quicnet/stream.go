@@ -0,0 +1,224 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	quic "github.com/quic-go/quic-go"
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// msgStream 为任务、文件传输等独占的 QUIC 流，控制流只承载心跳、确认等小消息。
+// 流上的请求的确认和回复沿原流返回，流已关闭时改走控制流
+type msgStream struct {
+	session  quic.Connection
+	stream   quic.Stream
+	codec    Codec
+	read     frameOptions
+	write    frameOptions
+	info     StreamInfo
+	infoMu   sync.Mutex
+	writeMu  sync.Mutex
+	done     chan struct{}
+	closeOne sync.Once
+}
+
+// StreamInfo 描述连接上一条正在使用的流
+type StreamInfo struct {
+	ID int64
+	// Kind 为流上第一条消息的类型，例如 script_task
+	Kind string
+	// Key 为流所属的任务 ID 或请求 ID
+	Key      string
+	Local    bool
+	OpenedAt time.Time
+}
+
+func (ms *msgStream) writeMessage(msg *Message) error {
+	select {
+	case <-ms.done:
+		return errStreamClosed
+	default:
+	}
+	data, err := ms.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
+	_, err = writePacket(ms.stream, data, ms.write)
+	return err
+}
+
+func (ms *msgStream) close() {
+	ms.closeOne.Do(func() {
+		close(ms.done)
+		ms.stream.CancelRead(0)
+		ms.writeMu.Lock()
+		ms.stream.Close()
+		ms.writeMu.Unlock()
+	})
+}
+
+// openStream 在当前连接上打开一条新流，流在调用 close 后关闭。
+// 对端允许的流数量已用完时立即返回错误，调用方可以改走控制流
+func (c *Client) openStream(ctx context.Context, kind, key string) (*msgStream, error) {
+	cv, err := c.currentConn()
+	if err != nil {
+		return nil, err
+	}
+	c.connMu.RLock()
+	session := c.session
+	c.connMu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	ms := c.newMsgStream(session, stream, cv)
+	ms.info.Kind = kind
+	ms.info.Key = key
+	ms.info.Local = true
+	c.trackStream(ms)
+	go c.serveStream(ms)
+	return ms, nil
+}
+
+func (c *Client) newMsgStream(session quic.Connection, stream quic.Stream, cv *connView) *msgStream {
+	return &msgStream{
+		session: session,
+		stream:  stream,
+		codec:   cv.codec,
+		read:    cv.read,
+		write:   cv.write,
+		info:    StreamInfo{ID: int64(stream.StreamID()), OpenedAt: time.Now()},
+		done:    make(chan struct{}),
+	}
+}
+
+// acceptStreams 接受对端在 session 上打开的流，直到 session 关闭
+func (c *Client) acceptStreams(session quic.Connection) {
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		cv, err := c.currentConn()
+		if err != nil {
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		ms := c.newMsgStream(session, stream, cv)
+		c.trackStream(ms)
+		go c.serveStream(ms)
+	}
+}
+
+// serveStream 读取流上的消息并按控制流的方式处理，对端关闭流后结束。
+// 帧超过上限时与控制流一样关闭整个连接
+func (c *Client) serveStream(ms *msgStream) {
+	defer func() {
+		ms.close()
+		c.untrackStream(ms)
+	}()
+	for {
+		data, err := readPacket(ms.stream, ms.read)
+		var tooLarge *FrameTooLargeError
+		if errors.As(err, &tooLarge) {
+			log.Printf("Closing connection to %s: %s on stream %d", ms.session.RemoteAddr(), err, ms.info.ID)
+			ms.session.CloseWithError(CloseFrameTooLarge, err.Error())
+			return
+		}
+		if err != nil {
+			return
+		}
+		msg, err := ms.codec.Unmarshal(data)
+		if err != nil {
+			log.Printf("Failed to unmarshal message on stream %d: %s", ms.info.ID, err)
+			continue
+		}
+		msg.stream = ms
+		ms.infoMu.Lock()
+		if ms.info.Kind == "" {
+			ms.info.Kind = msg.Type
+			ms.info.Key = msg.ID
+		}
+		ms.infoMu.Unlock()
+		if c.handleIncoming(msg) {
+			continue
+		}
+		c.deliver(msg)
+	}
+}
+
+func (c *Client) trackStream(ms *msgStream) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if c.streams == nil {
+		c.streams = make(map[int64]*msgStream)
+	}
+	c.streams[ms.info.ID] = ms
+}
+
+func (c *Client) untrackStream(ms *msgStream) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if c.streams[ms.info.ID] == ms {
+		delete(c.streams, ms.info.ID)
+	}
+}
+
+// Streams 返回连接上除控制流外正在使用的流
+func (c *Client) Streams() []StreamInfo {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	infos := make([]StreamInfo, 0, len(c.streams))
+	for _, ms := range c.streams {
+		ms.infoMu.Lock()
+		infos = append(infos, ms.info)
+		ms.infoMu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Streams 返回 agent 当前连接上正在使用的流，agent 不存在时返回 nil
+func (cm *ClientManager) Streams(machineID string) []StreamInfo {
+	client := cm.GetClient(machineID)
+	if client == nil {
+		return nil
+	}
+	return client.Streams()
+}
+
+// CallStream 与 Call 相同，但请求和回复使用一条独占的流，适合回复较大或耗时较长的请求
+func (c *Client) CallStream(ctx context.Context, messageType string, payload interface{}) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{
+		ID:   uuid.New().String(),
+		Type: messageType,
+		Data: data,
+	}
+	ms, err := c.openStream(ctx, messageType, msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer ms.close()
+	msg.stream = ms
+	return c.call(ctx, msg)
+}
@@ -0,0 +1,152 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+func findStream(streams []StreamInfo, key string) (StreamInfo, bool) {
+	for _, info := range streams {
+		if info.Key == key {
+			return info, true
+		}
+	}
+	return StreamInfo{}, false
+}
+
+func TestDispatchTaskStream(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f, err := s.Dispatch(ctx, c.MachineID, &ScriptTaskRequest{TaskID: "stream-task", Content: "sleep 0.5; echo done"})
+	if err != nil {
+		t.Fatalf("Failed to dispatch task: %s", err)
+	}
+	info, ok := findStream(s.ClientManager().Streams(c.MachineID), "stream-task")
+	if !ok || info.Kind != "script_task" || !info.Local {
+		t.Errorf("Expected a local script_task stream for the task, but got %+v (found: %v)", info, ok)
+	}
+	// agent 一侧以流上第一条消息标记流
+	eventually(t, 3*time.Second, func() bool {
+		info, ok := findStream(c.Streams(), f.MsgID)
+		return ok && info.Kind == "script_task" && !info.Local
+	})
+
+	if result, err := f.Result(); err != nil || result.Stdout != "done\n" {
+		t.Fatalf("Expected the task to succeed, but got %+v, %v", result, err)
+	}
+	// 任务结束后两端的流都被关闭
+	eventually(t, 3*time.Second, func() bool {
+		return len(s.ClientManager().Streams(c.MachineID)) == 0 && len(c.Streams()) == 0
+	})
+	if streams := s.ClientManager().Streams("unknown"); streams != nil {
+		t.Errorf("Expected no streams for an unknown agent, but got %+v", streams)
+	}
+}
+
+func TestDispatchFallsBackToControlStream(t *testing.T) {
+	s := newTestServer(t)
+	// agent 不接受服务端打开的流，任务改走控制流
+	c, err := NewClient(testServerAddr(s), testClientTLS(), &quic.Config{MaxIncomingStreams: -1})
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer c.Close()
+	eventually(t, 3*time.Second, func() bool { return s.ClientManager().GetClient(c.MachineID) != nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := s.Dispatch(ctx, c.MachineID, &ScriptTaskRequest{TaskID: "fallback", Content: "echo done"})
+	if err != nil {
+		t.Fatalf("Failed to dispatch task: %s", err)
+	}
+	if streams := s.ClientManager().Streams(c.MachineID); len(streams) != 0 {
+		t.Errorf("Expected no task stream, but got %+v", streams)
+	}
+	if result, err := f.Result(); err != nil || result.Stdout != "done\n" {
+		t.Errorf("Expected the task to succeed over the control stream, but got %+v, %v", result, err)
+	}
+}
+
+// openRawStream 在 agent 的连接上打开一条流，并写入声明长度为 size、实际只有 n 字节的帧
+func openRawStream(t *testing.T, c *Client, size uint32, n int) {
+	t.Helper()
+	c.connMu.RLock()
+	session := c.session
+	c.connMu.RUnlock()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %s", err)
+	}
+	buf := make([]byte, frameHeaderSize+n)
+	binary.BigEndian.PutUint32(buf, size)
+	if _, err := stream.Write(buf); err != nil {
+		t.Fatalf("Failed to write frame: %s", err)
+	}
+}
+
+func TestStreamFrameTooLarge(t *testing.T) {
+	s := newTestServer(t, WithServerMaxFrameSize(1024))
+	causes := make(chan error, 10)
+	c := newTestClient(t, s, WithConnStateFunc(func(state ConnState, addr string, err error) {
+		if state == StateDisconnected {
+			causes <- err
+		}
+	}))
+
+	openRawStream(t, c, 4096, 0)
+	select {
+	case err := <-causes:
+		var appErr *quic.ApplicationError
+		if !errors.As(err, &appErr) || appErr.ErrorCode != CloseFrameTooLarge {
+			t.Errorf("Expected the connection to be closed with %d, but got %v", CloseFrameTooLarge, err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Expected the server to close the connection")
+	}
+}
+
+// TestLargeResultDoesNotBlockHeartbeat 检查任务流上未传输完的大结果不影响控制流上的心跳
+func TestLargeResultDoesNotBlockHeartbeat(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	before, _ := s.ClientManager().Presence(c.MachineID)
+
+	openRawStream(t, c, 8<<20, 256<<10)
+	time.Sleep(20 * time.Millisecond)
+	c.sendHeartbeat()
+	eventually(t, 3*time.Second, func() bool {
+		info, _ := s.ClientManager().Presence(c.MachineID)
+		return info.LastSeen.After(before.LastSeen)
+	})
+	if streams := s.ClientManager().Streams(c.MachineID); len(streams) != 1 {
+		t.Errorf("Expected the unfinished stream to stay open, but got %+v", streams)
+	}
+}
+
+func TestLargeResultRepliesWithError(t *testing.T) {
+	s := newTestServer(t, WithServerMaxFrameSize(32<<10))
+	c := newTestClient(t, s, WithSpool(SpoolConfig{Dir: t.TempDir()}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req := &ScriptTaskRequest{Content: "head -c 100000 /dev/zero | tr '\\0' a"}
+	f, err := s.Dispatch(ctx, c.MachineID, req)
+	if err != nil {
+		t.Fatalf("Failed to dispatch task: %s", err)
+	}
+	// 超过服务端上限的结果以错误回复，而不是留在磁盘队列中反复重发
+	_, err = f.Result()
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != ErrCodeFrameTooLarge {
+		t.Errorf("Expected a %s error, but got %v", ErrCodeFrameTooLarge, err)
+	}
+	eventually(t, 3*time.Second, func() bool { return len(c.spool.Pending()) == 0 })
+}
@@ -1,5 +1,7 @@
 package quicnet
 
+import "fmt"
+
 type TaskStatus int
 
 const (
@@ -7,8 +9,37 @@ const (
 	TaskStatusRunning
 	TaskStatusCompleted
 	TaskStatusFailed
+	TaskStatusStopped
 )
 
+var taskStatusNames = [...]string{"created", "running", "completed", "failed", "stopped"}
+
+func (s TaskStatus) String() string {
+	if s < 0 || int(s) >= len(taskStatusNames) {
+		return fmt.Sprintf("TaskStatus(%d)", int(s))
+	}
+	return taskStatusNames[s]
+}
+
+// Finished 判断任务是否已结束
+func (s TaskStatus) Finished() bool {
+	return s >= TaskStatusCompleted
+}
+
+func (s TaskStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *TaskStatus) UnmarshalText(text []byte) error {
+	for i, name := range taskStatusNames {
+		if name == string(text) {
+			*s = TaskStatus(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown task status %q", text)
+}
+
 type Task interface {
 	GetTaskID() string
 	GetType() string
@@ -0,0 +1,130 @@
+package quicnet
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	msgTypeTaskCancel = "task_cancel"
+	msgTypeTaskStatus = "task_status"
+)
+
+// taskCancelWait 为取消任务后等待脚本退出的最长时间，超时后回复当时的状态
+const taskCancelWait = 10 * time.Second
+
+type TaskControlRequest struct {
+	TaskID string `json:"task_id"`
+}
+
+// TaskStatusReply 为 agent 上任务的当前状态，任务结束后 Result 为脚本的执行结果
+type TaskStatusReply struct {
+	TaskID      string           `json:"task_id"`
+	Status      TaskStatus       `json:"status"`
+	Created     time.Time        `json:"created"`
+	Updated     time.Time        `json:"updated"`
+	Transitions []TaskTransition `json:"transitions,omitempty"`
+	// QueuePosition 为任务在 agent 执行队列中的位置，从 1 开始，未在排队时为 0
+	QueuePosition int           `json:"queue_position,omitempty"`
+	Result        *ScriptResult `json:"result,omitempty"`
+}
+
+func (st *ScriptTask) statusReply() *TaskStatusReply {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	reply := &TaskStatusReply{
+		TaskID:      st.TaskID,
+		Status:      st.Status,
+		Created:     st.Created,
+		Updated:     st.Updated,
+		Transitions: append([]TaskTransition(nil), st.Transitions...),
+	}
+	if st.Status.Finished() {
+		reply.Result = st.ScriptResult
+	}
+	return reply
+}
+
+func taskStatusReply(task Task) *TaskStatusReply {
+	if st, ok := task.(*ScriptTask); ok {
+		return st.statusReply()
+	}
+	return &TaskStatusReply{TaskID: task.GetTaskID(), Status: task.GetStatus()}
+}
+
+func (c *Client) lookupTask(msg *Message) (Task, error) {
+	var req TaskControlRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return nil, NewRemoteError(ErrCodeBadRequest, "invalid task request: %s", err)
+	}
+	task := c.tm.GetTask(req.TaskID)
+	if task == nil {
+		return nil, NewRemoteError(ErrCodeNotFound, "task %s not found", req.TaskID)
+	}
+	return task, nil
+}
+
+// HandlerTaskStatus 回复 agent 上任务的当前状态
+func HandlerTaskStatus(msg *Message, c *Client) error {
+	if msg.IsReply() {
+		return nil
+	}
+	task, err := c.lookupTask(msg)
+	if err != nil {
+		return err
+	}
+	reply := taskStatusReply(task)
+	if !reply.Status.Finished() {
+		reply.QueuePosition = c.executor.position(reply.TaskID)
+	}
+	return c.Reply(msg, reply)
+}
+
+// HandlerTaskCancel 停止 agent 上正在运行的任务，等待脚本退出后回复任务状态；
+// 已结束的任务不受影响，直接回复其状态
+func HandlerTaskCancel(msg *Message, c *Client) error {
+	if msg.IsReply() {
+		return nil
+	}
+	task, err := c.lookupTask(msg)
+	if err != nil {
+		return err
+	}
+	if !task.GetStatus().Finished() {
+		if err := task.Stop(); err != nil {
+			return err
+		}
+		if st, ok := task.(*ScriptTask); ok && st.Done() != nil {
+			select {
+			case <-st.Done():
+			case <-time.After(taskCancelWait):
+			case <-msg.Context().Done():
+				return msg.Context().Err()
+			}
+		}
+	}
+	return c.Reply(msg, taskStatusReply(task))
+}
+
+// CancelTask 停止 agent 上的任务，返回停止后的任务状态
+func (s *Server) CancelTask(ctx context.Context, machineID, taskID string) (*TaskStatusReply, error) {
+	return s.taskControl(ctx, machineID, msgTypeTaskCancel, taskID)
+}
+
+// GetTaskStatus 查询 agent 上任务的当前状态，agent 只保留结束后一段时间内的任务
+func (s *Server) GetTaskStatus(ctx context.Context, machineID, taskID string) (*TaskStatusReply, error) {
+	return s.taskControl(ctx, machineID, msgTypeTaskStatus, taskID)
+}
+
+func (s *Server) taskControl(ctx context.Context, machineID, messageType, taskID string) (*TaskStatusReply, error) {
+	reply, err := s.Call(ctx, machineID, messageType, TaskControlRequest{TaskID: taskID})
+	if err != nil {
+		return nil, err
+	}
+	var status TaskStatusReply
+	if err := json.Unmarshal(reply.Data, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
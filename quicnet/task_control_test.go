@@ -0,0 +1,49 @@
+package quicnet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScriptTaskStatus(t *testing.T) {
+	task := NewScriptTask(&ScriptTaskRequest{TaskID: "t1", Content: "sleep 5", Timeout: 10})
+	go task.Run()
+	task.SetStatus(TaskStatusRunning)
+	time.Sleep(100 * time.Millisecond)
+	task.Stop()
+	select {
+	case <-task.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the task to stop within 5s")
+	}
+	if task.ScriptResult.Code != CodeStopped {
+		t.Fatalf("Expected code %s, but got %s", CodeStopped, task.ScriptResult.Code)
+	}
+	task.SetStatus(task.ScriptResult.status())
+
+	data, err := json.Marshal(task.statusReply())
+	if err != nil {
+		t.Fatalf("Failed to marshal status reply: %s", err)
+	}
+	var reply TaskStatusReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatalf("Failed to unmarshal status reply: %s", err)
+	}
+	if reply.Status != TaskStatusStopped || reply.Result == nil {
+		t.Fatalf("Expected a stopped status with a result, but got %+v", reply)
+	}
+	var got []TaskStatus
+	for _, tr := range reply.Transitions {
+		got = append(got, tr.Status)
+	}
+	want := []TaskStatus{TaskStatusCreated, TaskStatusRunning, TaskStatusStopped}
+	if len(got) != len(want) {
+		t.Fatalf("Expected transitions %v, but got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected transitions %v, but got %v", want, got)
+		}
+	}
+}
@@ -6,7 +6,8 @@ import (
 	"github.com/patrickmn/go-cache"
 )
 
-
+// finishedTaskRetention 为已结束的任务保留供查询的时间
+const finishedTaskRetention = 30 * time.Minute
 
 type TaskManager struct {
 	tasks *cache.Cache
@@ -25,7 +26,11 @@ func (tm *TaskManager) AddTask(task Task) {
 func (tm *TaskManager) UpdateTaskStatus(taskID string, status TaskStatus) {
 	if task, found := tm.tasks.Get(taskID); found {
 		task.(Task).SetStatus(status)
-		tm.tasks.Set(taskID, task, cache.DefaultExpiration)
+		expiration := cache.DefaultExpiration
+		if status.Finished() {
+			expiration = finishedTaskRetention
+		}
+		tm.tasks.Set(taskID, task, expiration)
 	}
 }
 
@@ -38,4 +43,4 @@ func (tm *TaskManager) GetTask(taskID string) Task {
 
 func (tm *TaskManager) RemoveTask(taskID string) {
 	tm.tasks.Delete(taskID)
-}
\ No newline at end of file
+}
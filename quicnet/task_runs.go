@@ -0,0 +1,191 @@
+package quicnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const taskRunsFile = "task_runs.log"
+
+// taskRunLog 在磁盘队列目录中记录执行过的任务及其结果，agent 重启后重复下发的任务不会再次执行。
+// 记录以追加方式写入，超过窗口大小的两倍时只保留最近的记录重写文件
+type taskRunLog struct {
+	mu      sync.Mutex
+	path    string
+	size    int
+	f       *os.File
+	records int
+	order   []string
+	latest  map[string]*taskRunRecord
+}
+
+type taskRunRecord struct {
+	TaskID string        `json:"task_id"`
+	Done   bool          `json:"done,omitempty"`
+	Result *ScriptResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func openTaskRunLog(dir string, size int) (*taskRunLog, error) {
+	l := &taskRunLog{
+		path:   filepath.Join(dir, taskRunsFile),
+		size:   size,
+		latest: make(map[string]*taskRunRecord),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if err := l.rewrite(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *taskRunLog) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolRecordSize)
+	for scanner.Scan() {
+		var rec taskRunRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// 进程崩溃时最后一条记录可能只写了一半
+			log.Printf("Truncated task run record in %s: %s", l.path, err)
+			break
+		}
+		l.remember(&rec)
+	}
+	return scanner.Err()
+}
+
+func (l *taskRunLog) remember(rec *taskRunRecord) {
+	if _, ok := l.latest[rec.TaskID]; !ok {
+		l.order = append(l.order, rec.TaskID)
+	}
+	l.latest[rec.TaskID] = rec
+	for len(l.order) > l.size {
+		delete(l.latest, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// rewrite 用内存中的记录重写文件，之后的记录追加到新文件中
+func (l *taskRunLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range l.order {
+		data, err := json.Marshal(l.latest[id])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	l.records = len(l.order)
+	return err
+}
+
+func (l *taskRunLog) append(rec *taskRunRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("task run log %s is closed", l.path)
+	}
+
+	l.remember(rec)
+	if l.records >= 2*l.size {
+		return l.rewrite()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.records++
+	return l.f.Sync()
+}
+
+// start 在脚本开始执行前记录任务，之后即使 agent 重启也不会再次执行
+func (l *taskRunLog) start(taskID string) {
+	if err := l.append(&taskRunRecord{TaskID: taskID}); err != nil {
+		log.Printf("Failed to record start of task %s: %s", taskID, err)
+	}
+}
+
+func (l *taskRunLog) finish(taskID string, result *ScriptResult, err error) {
+	rec := &taskRunRecord{TaskID: taskID, Done: true, Result: result}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := l.append(rec); err != nil {
+		log.Printf("Failed to record result of task %s: %s", taskID, err)
+	}
+}
+
+// restore 将记录的任务放入执行窗口。重启前未执行完的任务以 CodeInterrupted 结束，不会再次执行
+func (l *taskRunLog) restore(w *dedupeWindow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range l.order {
+		rec := l.latest[id]
+		run := &taskRun{done: make(chan struct{}), result: rec.Result}
+		switch {
+		case !rec.Done:
+			run.result = &ScriptResult{
+				Code:     CodeInterrupted,
+				Error:    "agent restarted while the task was running",
+				ExitCode: -1,
+			}
+		case rec.Error != "":
+			run.err = NewRemoteError(ErrCodeInternal, "%s", rec.Error)
+		}
+		close(run.done)
+		w.add(id, run)
+	}
+}
+
+func (l *taskRunLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}